@@ -6,6 +6,7 @@ import (
 	"errors"
 	"runtime"
 	"sync/atomic"
+	"time"
 )
 
 // Constructor, destructors and options
@@ -13,26 +14,29 @@ import (
 const (
 	DefaultMaxQueryLen     = 4096
 	DefaultMaxPreparedStmt = 16
+	DefaultMaxPinnedStmt   = 16
 	DefaultMaxStmt         = 1024
-	defaultWrkThreshold    = 5000
+	DefaultMaxTrackedBytes = 8 << 20
+	DefaultWorkerInterval  = 10 * time.Second
+	DefaultPrepareTimeout  = 3 * time.Second
+	DefaultWorkerThreshold = 5000
+	DefaultDecayHalfLife   = time.Minute
+	maxPrepareBackoff      = time.Hour
 )
 
 // New creates a new SQLStmtCache, with the provided options, that wraps the provided *sql.DB instance.
 func New(db *sql.DB, opts ...SQLStmtCacheOpt) (*SQLStmtCache, error) {
-	c := &SQLStmtCache{
-		c:            db,
-		maxPS:        DefaultMaxPreparedStmt,
-		maxSqlLen:    DefaultMaxQueryLen,
-		maxStmt:      DefaultMaxStmt,
-		stmt:         make(map[string]*stmt),
-		wrkThreshold: defaultWrkThreshold,
+	c, err := newSQLStmtCache(db, time.Now, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	// apply user-supplied options
-	for _, opt := range opts {
-		if err := opt(c); err != nil {
-			return nil, err
-		}
+	go c.worker()
+	if c.trace != nil {
+		go c.trace.run()
+	}
+	if c.shrinkOnGC {
+		c.armGCSentinel()
 	}
 
 	// automatically call Close() to destroy all PSs if the user
@@ -44,6 +48,50 @@ func New(db *sql.DB, opts ...SQLStmtCacheOpt) (*SQLStmtCache, error) {
 	return c, nil
 }
 
+// newSQLStmtCache creates a new SQLStmtCache, without starting the background
+// worker. clock is used by the worker to decay hits and expire statements.
+func newSQLStmtCache(db *sql.DB, clock func() time.Time, opts []SQLStmtCacheOpt) (*SQLStmtCache, error) {
+	c := &SQLStmtCache{&sqlStmtCache{
+		clock:          clock,
+		c:              db,
+		maxPS:          DefaultMaxPreparedStmt,
+		maxPinned:      DefaultMaxPinnedStmt,
+		maxSqlLen:      DefaultMaxQueryLen,
+		maxStmt:        DefaultMaxStmt,
+		maxBytes:       DefaultMaxTrackedBytes,
+		wrkThreshold:   DefaultWorkerThreshold,
+		wrkInterval:    DefaultWorkerInterval,
+		prepareTimeout: DefaultPrepareTimeout,
+		decayHalfLife:  DefaultDecayHalfLife,
+		labels:         labelTable{max: DefaultMaxLabelSets},
+		wrkSignal:      make(chan struct{}, 1),
+		wrkShrink:      make(chan struct{}, 1),
+		wrkTasks:       make(chan func()),
+		wrkStop:        make(chan struct{}),
+		wrkDone:        make(chan struct{}),
+	}}
+	c.lastDecay = clock()
+	c.now = c.lastDecay.UnixNano()
+
+	// apply user-supplied options
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.checkPinned(); err != nil {
+		return nil, err
+	}
+	if c.idleTTL != 0 && c.idleTTL < 2*c.wrkInterval {
+		// the last use of the statements is sampled by the worker, so with a
+		// shorter TTL statements in constant use could be expired
+		return nil, errors.New("WithIdleTTL should be at least twice WithWorkerInterval")
+	}
+	c.stmt.init()
+	c.buildInvoker()
+	return c, nil
+}
+
 type SQLStmtCacheOpt func(*SQLStmtCache) error
 
 // WithMaxPreparedStmt specifies the maximum number of prepared statements
@@ -77,7 +125,24 @@ func WithMaxStmt(max int) SQLStmtCacheOpt {
 		if max < 128 {
 			return errors.New("WithMaxStmt should be at least 128")
 		}
-		c.maxStmt = max
+		c.maxStmt = int64(max)
+		return nil
+	}
+}
+
+// WithMaxTrackedBytes specifies a soft upper limit on how much memory, in bytes, can be
+// used to track the SQL statements (including the text of the statements), in addition
+// to the limit on the number of statements set by WithMaxStmt.
+// It defaults to DefaultMaxTrackedBytes.
+func WithMaxTrackedBytes(max int) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if int64(max) > 1<<32 {
+			return errors.New("WithMaxTrackedBytes should be no more than 4294967296")
+		}
+		if max < 1<<16 {
+			return errors.New("WithMaxTrackedBytes should be at least 65536")
+		}
+		c.maxBytes = int64(max)
 		return nil
 	}
 }
@@ -93,27 +158,179 @@ func WithMaxQueryLen(max int) SQLStmtCacheOpt {
 		if max < 32 {
 			return errors.New("WithMaxQueryLen should be at least 32")
 		}
-		c.maxSqlLen = max
+		c.maxSqlLen = int64(max)
+		return nil
+	}
+}
+
+// WithWorkerInterval specifies how often the background worker updates the
+// statistics and the set of prepared statements, regardless of how many queries
+// have been executed in the meantime. It defaults to DefaultWorkerInterval.
+func WithWorkerInterval(d time.Duration) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if d > time.Hour {
+			return errors.New("WithWorkerInterval should be no more than 1h")
+		}
+		if d < 10*time.Millisecond {
+			return errors.New("WithWorkerInterval should be at least 10ms")
+		}
+		c.wrkInterval = d
+		return nil
+	}
+}
+
+// WithWorkerThreshold specifies after how many queries the background worker
+// updates the statistics and the set of prepared statements, in addition to the
+// runs every WithWorkerInterval. Lower values make the cache adapt faster to
+// changes in the workload (and warm up faster in services with little traffic),
+// at the cost of running the worker more often. It defaults to
+// DefaultWorkerThreshold.
+func WithWorkerThreshold(n int) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if n > 1<<20 {
+			return errors.New("WithWorkerThreshold should be no more than 1048576")
+		}
+		if n < 1 {
+			return errors.New("WithWorkerThreshold should be at least 1")
+		}
+		c.wrkThreshold = uint32(n)
+		return nil
+	}
+}
+
+// WithDecayHalfLife specifies after how much time the execution frequency of the
+// statements, used to pick the statements to prepare, halves when the background
+// worker is woken up by the passage of time (see WithWorkerInterval). Longer
+// values make the set of prepared statements more stable, shorter ones make it
+// adapt faster when traffic stops. It defaults to DefaultDecayHalfLife.
+func WithDecayHalfLife(d time.Duration) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if d > 24*time.Hour {
+			return errors.New("WithDecayHalfLife should be no more than 24h")
+		}
+		if d < time.Second {
+			return errors.New("WithDecayHalfLife should be at least 1s")
+		}
+		c.decayHalfLife = d
+		return nil
+	}
+}
+
+// WithQueryDecayHalfLife specifies after how many queries the execution frequency
+// of the statements, used to pick the statements to prepare, halves when the
+// background worker is woken up by the number of queries (see
+// WithWorkerThreshold). Longer values make the set of prepared statements more
+// stable, shorter ones make it adapt faster to changes in the workload. It
+// defaults to the value of WithWorkerThreshold, i.e. the frequencies are halved
+// at every run of the worker.
+func WithQueryDecayHalfLife(n int) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if n > 1<<30 {
+			return errors.New("WithQueryDecayHalfLife should be no more than 1073741824")
+		}
+		if n < 1 {
+			return errors.New("WithQueryDecayHalfLife should be at least 1")
+		}
+		c.decayQueries = uint64(n)
+		return nil
+	}
+}
+
+// WithPrepareTimeout specifies the maximum amount of time the background worker
+// waits for a statement to be prepared. It defaults to DefaultPrepareTimeout.
+func WithPrepareTimeout(d time.Duration) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if d > time.Minute {
+			return errors.New("WithPrepareTimeout should be no more than 1m")
+		}
+		if d < time.Millisecond {
+			return errors.New("WithPrepareTimeout should be at least 1ms")
+		}
+		c.prepareTimeout = d
+		return nil
+	}
+}
+
+// WithIdleTTL specifies for how long a statement has to go unused before autoprepare
+// stops tracking it and, if it was prepared, closes the corresponding prepared
+// statement. This allows to release all resources, also on the database, when traffic
+// stops. As usage is sampled by the background worker, the TTL has a granularity
+// of the interval specified with WithWorkerInterval, and it must be at least twice
+// that interval. It defaults to 0, that disables the expiration of idle statements.
+func WithIdleTTL(d time.Duration) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if d < 0 {
+			return errors.New("WithIdleTTL should be at least 0")
+		}
+		c.idleTTL = d
+		return nil
+	}
+}
+
+// WithShrinkOnGC makes autoprepare shrink the cache at every GC cycle: the statements
+// that are not prepared and are not frequently used stop being tracked, and the
+// prepared statements that are not being used anymore are closed.
+// See also WithSoftMemoryLimit.
+func WithShrinkOnGC() SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		c.shrinkOnGC = true
+		return nil
+	}
+}
+
+// WithSoftMemoryLimit makes autoprepare shrink the cache during GC cycles only if the
+// Go heap is bigger than the specified number of bytes. When this happens the cache is
+// shrunk more aggressively than with WithShrinkOnGC, as also the least frequently used
+// half of the prepared statements is closed.
+// It implies WithShrinkOnGC.
+func WithSoftMemoryLimit(bytes int) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if bytes < 1<<20 {
+			return errors.New("WithSoftMemoryLimit should be at least 1MB")
+		}
+		c.shrinkOnGC = true
+		c.softMemLimit = uint64(bytes)
 		return nil
 	}
 }
 
-// Close closes and frees all resources associated with the prepared statement cache.
+// WithHashedKeys makes autoprepare look up the tracked statements using a 64 bit
+// fingerprint (computed with hash/maphash) of the SQL query, instead of the query
+// itself. This allows to compute the fingerprint outside of the internal lock,
+// and to store the text of each tracked statement only once: all call sites
+// executing the same query will share the same copy. Fingerprint collisions are
+// handled by comparing the full query text.
+func WithHashedKeys() SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		c.stmt.hashed = true
+		return nil
+	}
+}
+
+// Close closes and frees all resources associated with the prepared statement cache,
+// including the background worker.
 // The SQLStmtCache should not be used after Close() has been called.
 func (c *SQLStmtCache) Close() {
+	c.closeOnce.Do(func() {
+		close(c.wrkStop)
+		<-c.wrkDone
+		c.trace.close()
+	})
+
 	c.l.Lock()
 	defer c.l.Unlock()
-	if c.stmt == nil {
+	if c.stmt.closed() {
 		return
 	}
-	for _, s := range c.stmt {
+	c.stmt.each(func(s *stmt) {
 		if s.prepared() {
 			s.close()
-			atomic.AddUint32(&c.psCount, ^uint32(0))
-			atomic.AddUint64(&c.stats.Unprepared, 1)
+			atomic.AddUint32(c.preparedCount(s), ^uint32(0))
+			atomic.AddUint64(c.unpreparedCount(), 1)
 		}
-	}
-	c.stmt = nil
+	})
+	c.stmt.reset()
+	atomic.StoreInt64(&c.trackedBytes, 0)
 }
 
 // Query functions
@@ -121,85 +338,49 @@ func (c *SQLStmtCache) Close() {
 // QueryContext is equivalent to (*sql.DB).QueryContext, but it transparently creates and uses
 // prepared statements for the most frequently-executed queries.
 func (c *SQLStmtCache) QueryContext(ctx context.Context, sql string, values ...interface{}) (*sql.Rows, error) {
-	s := c.getPS(ctx, sql)
-	ps := s.acquire()
-	if ps == nil {
-		atomic.AddUint64(&c.stats.Misses, 1)
-		return c.c.QueryContext(ctx, sql, values...)
-	}
-	defer s.release()
-	atomic.AddUint64(&c.stats.Hits, 1)
-	return ps.QueryContext(ctx, values...)
+	call := &Call{Op: OpQuery, Query: sql, Args: values}
+	err := c.do(ctx, call)
+	return call.Rows, err
 }
 
 // QueryRowContext is equivalent to (*sql.DB).QueryRowContext, but it transparently creates and uses
 // prepared statements for the most frequently-executed queries.
 func (c *SQLStmtCache) QueryRowContext(ctx context.Context, sql string, values ...interface{}) *sql.Row {
-	s := c.getPS(ctx, sql)
-	ps := s.acquire()
-	if ps == nil {
-		atomic.AddUint64(&c.stats.Misses, 1)
-		return c.c.QueryRowContext(ctx, sql, values...)
-	}
-	defer s.release()
-	atomic.AddUint64(&c.stats.Hits, 1)
-	return ps.QueryRowContext(ctx, values...)
+	call := &Call{Op: OpQueryRow, Query: sql, Args: values}
+	c.do(ctx, call)
+	return call.Row
 }
 
 // ExecContext is equivalent to (*sql.DB).ExecContext, but it transparently creates and uses
 // prepared statements for the most frequently-executed queries.
 func (c *SQLStmtCache) ExecContext(ctx context.Context, sql string, values ...interface{}) (sql.Result, error) {
-	s := c.getPS(ctx, sql)
-	ps := s.acquire()
-	if ps == nil {
-		atomic.AddUint64(&c.stats.Misses, 1)
-		return c.c.ExecContext(ctx, sql, values...)
-	}
-	defer s.release()
-	atomic.AddUint64(&c.stats.Hits, 1)
-	return ps.ExecContext(ctx, values...)
+	call := &Call{Op: OpExec, Query: sql, Args: values}
+	err := c.do(ctx, call)
+	return call.Result, err
 }
 
 // QueryContextTx is equivalent to tx.QueryContext, but it transparently creates and uses
 // prepared statements for the most frequently-executed queries.
 func (c *SQLStmtCache) QueryContextTx(ctx context.Context, tx *sql.Tx, sql string, values ...interface{}) (*sql.Rows, error) {
-	s := c.getPS(ctx, sql)
-	ps := s.acquire()
-	if ps == nil {
-		atomic.AddUint64(&c.stats.Misses, 1)
-		return tx.QueryContext(ctx, sql, values...)
-	}
-	defer s.release()
-	atomic.AddUint64(&c.stats.Hits, 1)
-	return tx.StmtContext(ctx, ps).QueryContext(ctx, values...)
+	call := &Call{Op: OpQuery, Query: sql, Args: values, Tx: tx}
+	err := c.do(ctx, call)
+	return call.Rows, err
 }
 
 // QueryRowContextTx is equivalent to tx.QueryRowContext, but it transparently creates and uses
 // prepared statements for the most frequently-executed queries.
 func (c *SQLStmtCache) QueryRowContextTx(ctx context.Context, tx *sql.Tx, sql string, values ...interface{}) *sql.Row {
-	s := c.getPS(ctx, sql)
-	ps := s.acquire()
-	if ps == nil {
-		atomic.AddUint64(&c.stats.Misses, 1)
-		return tx.QueryRowContext(ctx, sql, values...)
-	}
-	defer s.release()
-	atomic.AddUint64(&c.stats.Hits, 1)
-	return tx.StmtContext(ctx, ps).QueryRowContext(ctx, values...)
+	call := &Call{Op: OpQueryRow, Query: sql, Args: values, Tx: tx}
+	c.do(ctx, call)
+	return call.Row
 }
 
 // ExecContextTx is equivalent to tx.ExecContext, but it transparently creates and uses
 // prepared statements for the most frequently-executed queries.
 func (c *SQLStmtCache) ExecContextTx(ctx context.Context, tx *sql.Tx, sql string, values ...interface{}) (sql.Result, error) {
-	s := c.getPS(ctx, sql)
-	ps := s.acquire()
-	if ps == nil {
-		atomic.AddUint64(&c.stats.Misses, 1)
-		return tx.ExecContext(ctx, sql, values...)
-	}
-	defer s.release()
-	atomic.AddUint64(&c.stats.Hits, 1)
-	return tx.StmtContext(ctx, ps).ExecContext(ctx, values...)
+	call := &Call{Op: OpExec, Query: sql, Args: values, Tx: tx}
+	err := c.do(ctx, call)
+	return call.Result, err
 }
 
 // Statistics functions
@@ -210,6 +391,31 @@ type SQLStmtCacheStats struct {
 	Hits       uint64 // number of SQL queries that used automatically-prepared statements
 	Misses     uint64 // number of SQL queries executed raw
 	Skips      uint64 // number of SQL queries that do not qualify for caching
+	Expired    uint64 // number of statements that stopped being tracked because they were idle
+	Shrinks    uint64 // number of times the cache was shrunk because of GC or memory pressure
+	Trimmed    uint64 // number of statements that stopped being tracked because the cache was shrunk
+
+	WouldPrepare   uint64 // number of statements that would have been prepared (see WithShadowMode)
+	WouldUnprepare uint64 // number of statements that would have been closed (see WithShadowMode)
+
+	TraceDropped uint64 // number of sampled queries not written by the trace recorder (see WithTraceRecorder)
+
+	// Breakdown, by reason, of the SQL queries that were executed raw (Skips and Misses)
+	Disabled      uint64 // the cache is disabled (see WithMaxPreparedStmt)
+	TooLong       uint64 // the query is longer than allowed by WithMaxQueryLen
+	TableFull     uint64 // the query is not tracked, as too many statements are tracked (see WithMaxStmt and WithMaxTrackedBytes)
+	NotHot        uint64 // the query is tracked, but it is not (yet) executed frequently enough to be prepared
+	Blacklisted   uint64 // the query failed to be prepared recently, so it is not prepared again for a while
+	NotPreparable uint64 // the query is not eligible to be prepared (see WithAllowRules and WithDenyRules)
+	Canceled      uint64 // the context of the query was already done
+	Bypassed      uint64 // the context of the query was returned by NoPrepare
+	WouldHit      uint64 // the query would have used a prepared statement (see WithShadowMode)
+	Paused        uint64 // the query is not tracked, as tracking is paused (see Pause)
+
+	TrackedStmts  uint64 // number of statements currently tracked
+	PreparedStmts uint64 // number of statements currently prepared
+	PinnedStmts   uint64 // number of statements currently pinned (included in PreparedStmts)
+	TrackedBytes  uint64 // approximate memory currently used to track statements
 }
 
 // GetStats returns statistics about the state and effectiveness of the prepared statements cache.
@@ -220,5 +426,35 @@ func (c *SQLStmtCache) GetStats() SQLStmtCacheStats {
 		Skips:      atomic.LoadUint64(&c.stats.Skips),
 		Prepared:   atomic.LoadUint64(&c.stats.Prepared),
 		Unprepared: atomic.LoadUint64(&c.stats.Unprepared),
+		Expired:    atomic.LoadUint64(&c.stats.Expired),
+		Shrinks:    atomic.LoadUint64(&c.stats.Shrinks),
+		Trimmed:    atomic.LoadUint64(&c.stats.Trimmed),
+
+		WouldPrepare:   atomic.LoadUint64(&c.stats.WouldPrepare),
+		WouldUnprepare: atomic.LoadUint64(&c.stats.WouldUnprepare),
+
+		TraceDropped: c.trace.droppedRecords(),
+
+		Disabled:      atomic.LoadUint64(&c.stats.Disabled),
+		TooLong:       atomic.LoadUint64(&c.stats.TooLong),
+		TableFull:     atomic.LoadUint64(&c.stats.TableFull),
+		NotHot:        atomic.LoadUint64(&c.stats.NotHot),
+		Blacklisted:   atomic.LoadUint64(&c.stats.Blacklisted),
+		NotPreparable: atomic.LoadUint64(&c.stats.NotPreparable),
+		Canceled:      atomic.LoadUint64(&c.stats.Canceled),
+		Bypassed:      atomic.LoadUint64(&c.stats.Bypassed),
+		WouldHit:      atomic.LoadUint64(&c.stats.WouldHit),
+		Paused:        atomic.LoadUint64(&c.stats.Paused),
+
+		TrackedStmts:  uint64(c.trackedStmts()),
+		PreparedStmts: uint64(atomic.LoadUint32(&c.psCount) + atomic.LoadUint32(&c.pinnedCount)),
+		PinnedStmts:   uint64(atomic.LoadUint32(&c.pinnedCount)),
+		TrackedBytes:  uint64(atomic.LoadInt64(&c.trackedBytes)),
 	}
 }
+
+func (c *sqlStmtCache) trackedStmts() int {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	return c.stmt.len()
+}
@@ -0,0 +1,51 @@
+package autoprepare
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// TestAtomicAlignment checks that the 64-bit fields accessed atomically are
+// 64-bit aligned, as required on 32-bit platforms (e.g. GOARCH=386).
+func TestAtomicAlignment(t *testing.T) {
+	var c sqlStmtCache
+	var s stmt
+	var tr traceRecorder
+	var lt labelTable
+	var lc labelCounters
+	var sl stmtLatency
+	for name, off := range map[string]uintptr{
+		"sqlStmtCache.trackedBytes": unsafe.Offsetof(c.trackedBytes),
+		"sqlStmtCache.now":          unsafe.Offsetof(c.now),
+		"sqlStmtCache.queries":      unsafe.Offsetof(c.queries),
+		"sqlStmtCache.maxSqlLen":    unsafe.Offsetof(c.maxSqlLen),
+		"sqlStmtCache.maxStmt":      unsafe.Offsetof(c.maxStmt),
+		"sqlStmtCache.maxBytes":     unsafe.Offsetof(c.maxBytes),
+		"sqlStmtCache.stats":        unsafe.Offsetof(c.stats),
+		"sqlStmtCache.latHit":       unsafe.Offsetof(c.latHit),
+		"sqlStmtCache.latMiss":      unsafe.Offsetof(c.latMiss),
+		"sqlStmtCache.latPrepare":   unsafe.Offsetof(c.latPrepare),
+		"sqlStmtCache.latUnprepare": unsafe.Offsetof(c.latUnprepare),
+		"sqlStmtCache.labels":       unsafe.Offsetof(c.labels),
+		"stmt.hit":                  unsafe.Offsetof(s.hit),
+		"stmt.used":                 unsafe.Offsetof(s.used),
+		"stmt.blacklisted":          unsafe.Offsetof(s.blacklisted),
+		"stmt.hits":                 unsafe.Offsetof(s.hits),
+		"stmt.misses":               unsafe.Offsetof(s.misses),
+		"stmt.prepareErrs":          unsafe.Offsetof(s.prepareErrs),
+		"traceRecorder.n":           unsafe.Offsetof(tr.n),
+		"traceRecorder.dropped":     unsafe.Offsetof(tr.dropped),
+		"labelTable.overflow":       unsafe.Offsetof(lt.overflow),
+		"labelCounters.hit":         unsafe.Offsetof(lc.hit),
+		"labelCounters.miss":        unsafe.Offsetof(lc.miss),
+		"stmtLatency.hit":           unsafe.Offsetof(sl.hit),
+		"stmtLatency.miss":          unsafe.Offsetof(sl.miss),
+	} {
+		if off%8 != 0 {
+			t.Errorf("%s is at offset %d, that is not 64-bit aligned", name, off)
+		}
+	}
+	if unsafe.Sizeof(SQLStmtCacheStats{})%8 != 0 || unsafe.Sizeof(histogram{})%8 != 0 {
+		t.Errorf("SQLStmtCacheStats and histogram should contain only 64-bit fields")
+	}
+}
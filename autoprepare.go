@@ -3,111 +3,471 @@ package autoprepare
 import (
 	"context"
 	"database/sql"
+	"math"
 	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// TODO: call wrk() during GC, and have it more aggressive (eventually all PS should be closed)
-
 // SQLStmtCache transparently caches and uses prepared SQL statements.
 type SQLStmtCache struct {
-	l    sync.RWMutex
-	stmt map[string]*stmt // protected by l
+	// The background worker only references the embedded sqlStmtCache, so that
+	// the finalizer set by New on the SQLStmtCache can still run (and stop the
+	// worker) if the user forgets to call Close.
+	*sqlStmtCache
+}
+
+type sqlStmtCache struct {
+	// The 64-bit fields that are accessed atomically come first, so that they
+	// are 64-bit aligned also on 32-bit platforms (see the sync/atomic docs).
 
-	psCount   uint32 // current number of prepared statements
-	hit       uint32 // number of lookups since last wrk start
-	wrkStatus uint32 // 0 wrk is not running, 1 wrk is running
+	trackedBytes int64  // approximate memory used by stmt; protected by l, read atomically by GetStats
+	now          int64  // coarse clock (UnixNano), updated by the worker at every run
+	queries      uint64 // number of lookups, updated every wrkThreshold lookups (see hit)
+
+	// limits; accessed atomically, as they can be changed by Reconfigure
+	maxSqlLen int64 // maximum length of SQL statements to be cached
+	maxStmt   int64 // maximum number of tracked statements
+	maxBytes  int64 // maximum memory used by tracked statements
 
 	stats SQLStmtCacheStats
 
+	// latency histograms
+	latHit       histogram // queries executed using prepared statements
+	latMiss      histogram // queries executed raw
+	latPrepare   histogram // creation of prepared statements
+	latUnprepare histogram // deletion of prepared statements
+
+	labels labelTable // statistics per label set (see WithLabel)
+
+	l    sync.RWMutex
+	stmt stmtTable // protected by l
+
+	psCount     uint32 // current number of prepared statements, excluding the pinned ones
+	pinnedCount uint32 // current number of pinned statements (see Pin)
+	hit         uint32 // number of lookups since last wrk start
+	frozen      uint32 // 1 if the set of prepared statements is frozen (see Freeze)
+	paused      uint32 // 1 if the tracking of statements is paused (see Pause)
+
+	lastDecay time.Time        // last time hits were decayed; used only by the worker
+	decayQs   uint64           // value of queries when hits were last decayed by number of queries; used only by the worker
+	warm      []hotSetEntry    // statements to be prepared when the worker starts (see WithWarmStart)
+	warmStmts int              // number of statements prepared by warmStart that may not have been executed yet; used only by the worker
+	toPin     []string         // statements to be pinned when the worker starts (see WithPinnedStatements)
+	clock     func() time.Time // wall clock used by the worker; replaced by the Simulator
+
+	wrkSignal chan struct{} // wakes up the worker before the next tick
+	wrkShrink chan struct{} // asks the worker to shrink the cache (see gc.go)
+	wrkTasks  chan func()   // functions to be executed by the worker (see run)
+	wrkStop   chan struct{} // closed by Close to stop the worker
+	wrkDone   chan struct{} // closed by the worker when it exits
+	closeOnce sync.Once
+
+	trace *traceRecorder // trace recorder (see WithTraceRecorder); nil if disabled
+
+	// limits; accessed atomically, as they can be changed by Reconfigure
+	maxPS        uint32 // maximum number of prepared statements, excluding the pinned ones
+	wrkThreshold uint32 // number of queries before waking up the worker
+
 	// configuration; constant after New() returns
-	c            *sql.DB // database connection
-	maxPS        uint32  // maximum number of prepared statements
-	maxSqlLen    int     // maximum length of SQL statements to be cached
-	maxStmt      int     // maximum number of tracked statements
-	wrkThreshold uint32  // number of queries before starting a backgorund update
+	c              *sql.DB       // database connection
+	maxPinned      uint32        // maximum number of pinned statements
+	wrkInterval    time.Duration // interval between time-driven worker runs
+	prepareTimeout time.Duration // timeout for preparing a statement
+	decayHalfLife  time.Duration // half-life of hits when the worker is woken up by the ticker
+	decayQueries   uint64        // half-life of hits, in queries, when the worker is woken up by the number of queries (0: wrkThreshold)
+	idleTTL        time.Duration // time after which unused statements are released (0: never)
+	shrinkOnGC     bool          // shrink the cache during GC cycles
+	hooks          Hooks         // user-supplied event hooks
+	stmtLatency    bool          // keep latency histograms for each statement
+	slowThreshold  time.Duration // minimum duration of the queries passed to slowSink
+	slowSink       SlowQuerySink // slow query log; nil if disabled
+	slowArgs       bool          // include the values of the arguments in the slow query log
+	interceptors   []Interceptor // user-supplied interceptors
+	invoker        Invoker       // interceptors chain, built by New
+	softMemLimit   uint64        // shrink the cache only if the heap is bigger than this (0: always)
+	allow          []Rule        // if not empty, only matching queries are eligible to be prepared
+	shadow         bool          // never prepare statements, only track what would be prepared
+	deny           []Rule        // matching queries are not eligible to be prepared
 }
 
-func (c *SQLStmtCache) getPS(ctx context.Context, query string) *stmt {
-	if c.maxPS == 0 {
+func (c *sqlStmtCache) getPS(ctx context.Context, query string) *stmt {
+	if atomic.LoadUint32(&c.maxPS) == 0 {
+		atomic.AddUint64(&c.stats.Disabled, 1)
+		c.skipped(query, ReasonDisabled)
+		return nil
+	}
+	hint := contextHints(ctx)
+	if hint.noPrepare {
+		atomic.AddUint64(&c.stats.Bypassed, 1)
+		c.skipped(query, ReasonBypassed)
 		return nil
 	}
-	if len(query) > c.maxSqlLen {
+	if int64(len(query)) > atomic.LoadInt64(&c.maxSqlLen) {
 		atomic.AddUint64(&c.stats.Skips, 1)
+		atomic.AddUint64(&c.stats.TooLong, 1)
+		c.skipped(query, ReasonTooLong)
+		return nil
+	}
+	if ctx.Err() != nil {
+		// the query is going to fail anyway: do not let it affect the statistics
+		atomic.AddUint64(&c.stats.Canceled, 1)
+		c.skipped(query, ReasonCanceled)
 		return nil
 	}
 
+	h := c.stmt.hash(query)
+
 	c.l.RLock() // FIXME: ctx
-	s, ok := c.stmt[query]
+	s := c.stmt.get(query, h)
+	room := s == nil && c.hasRoom(query)
 	c.l.RUnlock()
 
+	if atomic.LoadUint32(&c.paused) != 0 {
+		// only serve the statements that are already tracked
+		if s == nil {
+			atomic.AddUint64(&c.stats.Paused, 1)
+			c.skipped(query, ReasonPaused)
+		}
+		return s
+	}
+
 	hit := atomic.AddUint32(&c.hit, 1)
-	if hit > c.wrkThreshold && atomic.CompareAndSwapUint32(&c.hit, hit, 0) {
-		if atomic.CompareAndSwapUint32(&c.wrkStatus, 0, 1) {
-			go func() {
-				defer atomic.StoreUint32(&c.wrkStatus, 0)
-				c.wrk()
-			}()
+	if hit > atomic.LoadUint32(&c.wrkThreshold) && atomic.CompareAndSwapUint32(&c.hit, hit, 0) {
+		atomic.AddUint64(&c.queries, uint64(hit))
+		// if the worker is busy the signal is dropped: it is fine, as it means
+		// that the worker is already running
+		select {
+		case c.wrkSignal <- struct{}{}:
+		default:
 		}
 	}
 
-	if !ok {
+	if s == nil && room {
+		// evaluate the rules before taking the lock, as they may be slow; this
+		// is done only if there is room for the statement, so that a full table
+		// does not cause the rules to be evaluated on every query
+		eligible := c.eligible(query)
 		c.l.Lock() // FIXME: ctx
-		if len(c.stmt) < c.maxStmt {
-			if s, ok = c.stmt[query]; !ok {
-				// TODO: create a new object only once in N occurrences
-				c.stmt[query] = newStmt(query, 1)
-			}
+		if s = c.stmt.get(query, h); s == nil && c.hasRoom(query) {
+			// TODO: create a new object only once in N occurrences
+			s = newStmt(c.intern(query), h, 0, atomic.LoadInt64(&c.now))
+			s.notPreparable = !eligible
+			c.track(s)
 		}
 		c.l.Unlock()
-		if !ok {
-			return nil
-		}
+	}
+	if s == nil {
+		atomic.AddUint64(&c.stats.TableFull, 1)
+		c.skipped(query, ReasonTableFull)
+		return nil
 	}
 
-	atomic.AddUint64(&s.hit, 1)
+	atomic.AddUint64(&s.hit, hint.weight)
+	s.use(atomic.LoadInt64(&c.now))
+	if hint.force && !s.notPreparable && !s.prepared() && !s.isBlacklisted(atomic.LoadInt64(&c.now)) {
+		c.forcePrepare(ctx, s)
+	}
 	return s
 }
 
-func (c *SQLStmtCache) wrk() {
-	victim, replacement := c.getCandidates()
-	if victim != nil && atomic.LoadUint32(&c.psCount) >= c.maxPS {
-		victim.close()
-		atomic.AddUint32(&c.psCount, ^uint32(0))
-		atomic.AddUint64(&c.stats.Unprepared, 1)
+// skipped calls the OnSkip hook, if any.
+func (c *sqlStmtCache) skipped(query, reason string) {
+	if c.hooks.OnSkip != nil {
+		c.hooks.OnSkip(Event{Query: query, Reason: reason})
+	}
+}
+
+// do executes call, using the prepared statement for call.Query if available.
+func (c *sqlStmtCache) do(ctx context.Context, call *Call) error {
+	s := c.getPS(ctx, call.Query)
+	call.ps = s.acquire()
+	call.Prepared = call.ps != nil
+	if call.Prepared {
+		// release the prepared statement also if an interceptor or the driver
+		// panics, otherwise closing it would block forever
+		defer s.release()
 	}
-	if replacement != nil && c.psCount < c.maxPS {
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		ps, err := c.c.PrepareContext(ctx, replacement.q)
-		// TODO: blacklist for statements that fail to be prepared
-		if err == nil {
-			replacement.put(ps)
-			atomic.AddUint32(&c.psCount, 1)
-			atomic.AddUint64(&c.stats.Prepared, 1)
+	var err error
+	if len(c.interceptors) == 0 {
+		// calling execute directly keeps call from escaping to the heap
+		err = c.execute(ctx, call)
+	} else {
+		// the interceptors may retain call, so only a copy of it escapes
+		hc := new(Call)
+		*hc = *call
+		err = c.invoker(ctx, hc)
+		*call = *hc
+	}
+	c.labels.count(ctx, call.ps != nil, call.dur)
+	c.logSlowQuery(ctx, s, call, err)
+	c.trace.record(call)
+	if call.ps == nil {
+		c.countMiss(s, call.dur)
+	} else {
+		c.countHit(s, call.dur)
+	}
+	return err
+}
+
+// countHit records that a query, that took d, has been executed using the
+// prepared statement of s.
+func (c *sqlStmtCache) countHit(s *stmt, d time.Duration) {
+	c.latHit.observe(d)
+	atomic.AddUint64(&c.stats.Hits, 1)
+	atomic.AddUint64(&s.hits, 1)
+	if s.lat != nil {
+		s.lat.hit.observe(d)
+	}
+}
+
+// countMiss records that a query, that took d, has been executed raw. s is nil
+// if the query is not tracked, in which case the reason has already been counted
+// by getPS.
+func (c *sqlStmtCache) countMiss(s *stmt, d time.Duration) {
+	c.latMiss.observe(d)
+	atomic.AddUint64(&c.stats.Misses, 1)
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.misses, 1)
+	if s.lat != nil {
+		s.lat.miss.observe(d)
+	}
+	switch {
+	case c.shadow && s.prepared():
+		atomic.AddUint64(&c.stats.WouldHit, 1)
+	case s.notPreparable:
+		atomic.AddUint64(&c.stats.NotPreparable, 1)
+	case s.isBlacklisted(atomic.LoadInt64(&c.now)):
+		atomic.AddUint64(&c.stats.Blacklisted, 1)
+	default:
+		atomic.AddUint64(&c.stats.NotHot, 1)
+	}
+}
+
+// intern returns the string to be stored in a new stmt for query. When the
+// table is hashed the query text is stored only once, so it is copied: this
+// way all the call sites using the same query share the same copy, and the
+// tracked statement does not keep alive a (potentially much larger) buffer the
+// query may be a substring of.
+func (c *sqlStmtCache) intern(query string) string {
+	if !c.stmt.hashed {
+		return query
+	}
+	return string([]byte(query))
+}
+
+// trackedSize returns the approximate amount of memory used to track query,
+// including its latency histograms if WithStmtLatency is used.
+func (c *sqlStmtCache) trackedSize(query string) int64 {
+	if c.stmtLatency {
+		return trackedSize(query) + stmtLatencySize
+	}
+	return trackedSize(query)
+}
+
+// hasRoom returns whether query can be tracked without exceeding the limits set
+// by WithMaxStmt and WithMaxTrackedBytes. c.l must be held.
+func (c *sqlStmtCache) hasRoom(query string) bool {
+	return int64(c.stmt.len()) < atomic.LoadInt64(&c.maxStmt) &&
+		c.trackedBytes+c.trackedSize(query) <= atomic.LoadInt64(&c.maxBytes)
+}
+
+// track adds s to the tracked statements. c.l must be held for writing.
+func (c *sqlStmtCache) track(s *stmt) {
+	if c.stmtLatency && s.lat == nil {
+		s.lat = new(stmtLatency)
+	}
+	c.stmt.add(s)
+	atomic.AddInt64(&c.trackedBytes, c.trackedSize(s.q))
+}
+
+// untrack removes s, if it is still tracked, from the tracked statements.
+// c.l must be held for writing.
+func (c *sqlStmtCache) untrack(s *stmt) {
+	if c.stmt.remove(s) {
+		atomic.AddInt64(&c.trackedBytes, -c.trackedSize(s.q))
+	}
+}
+
+// worker runs wrk every time it is signaled by getPS (i.e. every wrkThreshold
+// queries) and every wrkInterval, until Close is called.
+func (c *sqlStmtCache) worker() {
+	defer close(c.wrkDone)
+
+	c.pinStatements()
+	c.warmStart()
+
+	t := time.NewTicker(c.wrkInterval)
+	defer t.Stop()
+
+	for {
+		var reason string
+		select {
+		case <-c.wrkStop:
+			return
+		case <-c.wrkSignal:
+			reason = ReasonQueries
+		case <-t.C:
+			reason = ReasonTicker
+		case <-c.wrkShrink:
+			reason = ReasonShrink
+		case f := <-c.wrkTasks:
+			f()
+			continue
+		}
+
+		start := time.Now()
+		if reason == ReasonShrink {
+			c.shrink()
+		} else {
+			c.wrk(reason == ReasonTicker)
 		}
+		callHook(c.hooks.OnWorkerCycle, Event{Duration: time.Since(start), Reason: reason})
+	}
+}
+
+// run executes f in the worker, so that f can safely modify the set of prepared
+// statements, and waits for f to complete. It returns false, without executing
+// f, if ctx is done or the cache is closed before the worker is able to execute f.
+func (c *sqlStmtCache) run(ctx context.Context, f func()) bool {
+	done := make(chan struct{})
+	task := func() {
+		defer close(done)
+		f()
+	}
+	select {
+	case c.wrkTasks <- task:
+		<-done
+		return true
+	case <-ctx.Done():
+		return false
+	case <-c.wrkStop:
+		return false
+	}
+}
+
+// wrk updates the set of prepared statements and the hit statistics. tick
+// signals whether wrk has been triggered by the passage of time, instead of by
+// the number of queries executed.
+func (c *sqlStmtCache) wrk(tick bool) {
+	now := c.clock()
+	atomic.StoreInt64(&c.now, now.UnixNano())
+
+	if atomic.LoadUint32(&c.paused) != 0 {
+		// hits are not being counted, so they must not decay either
+		c.lastDecay = now
+		return
+	}
+
+	if atomic.LoadUint32(&c.frozen) == 0 {
+		victim, replacement := c.getCandidates()
+		maxPS := atomic.LoadUint32(&c.maxPS)
+		if victim != nil && atomic.LoadUint32(&c.psCount) >= maxPS {
+			c.unprepare(victim, ReasonReplaced)
+		}
+		if replacement != nil && atomic.LoadUint32(&c.psCount) < maxPS {
+			ctx, cancel := context.WithTimeout(context.Background(), c.prepareTimeout)
+			defer cancel()
+			c.prepare(ctx, replacement)
+		}
+	}
+
+	// When triggered by the number of queries, hits decay according to the
+	// number of queries executed since they were last decayed (by default, they
+	// are halved). When triggered by the ticker, hits decay according to the
+	// time elapsed since they were last decayed, so that they keep decaying when
+	// traffic stops. As hits are integers, decay is applied only once enough
+	// queries have been executed, or enough time has elapsed, as otherwise
+	// truncation would make hits decay much faster than expected.
+	if elapsed := now.Sub(c.lastDecay); !tick {
+		halfLife := c.decayQueries
+		if halfLife == 0 {
+			halfLife = uint64(atomic.LoadUint32(&c.wrkThreshold))
+		}
+		// the signals sent while the worker is busy are dropped, so the
+		// queries must be counted instead of the runs
+		queries := atomic.LoadUint64(&c.queries)
+		if n := queries - c.decayQs; n >= halfLife/4 {
+			c.updateHits(math.Exp2(-float64(n) / float64(halfLife)))
+			c.decayQs = queries
+			c.lastDecay = now
+		}
+	} else if elapsed >= c.decayHalfLife/4 {
+		c.updateHits(math.Exp2(-float64(elapsed) / float64(c.decayHalfLife)))
+		c.lastDecay = now
+	}
+	c.dropWarmStmts()
+	c.expireStmts(now)
+	c.dropStmts(2, ReasonCold)
+}
+
+// prepare creates the prepared statement for s. It must be called only by the worker.
+func (c *sqlStmtCache) prepare(ctx context.Context, s *stmt) error {
+	if c.shadow {
+		s.putShadow(c.clock().UnixNano())
+		atomic.AddUint32(c.preparedCount(s), 1)
+		atomic.AddUint64(&c.stats.WouldPrepare, 1)
+		callHook(c.hooks.OnPrepare, Event{Query: s.q, Shadow: true})
+		return nil
+	}
+	start := time.Now()
+	ps, err := c.c.PrepareContext(ctx, s.q)
+	d := time.Since(start)
+	c.latPrepare.observe(d)
+	if err != nil {
+		s.prepareFailed(err, c.clock().UnixNano(), c.wrkInterval)
+		callHook(c.hooks.OnPrepareError, Event{Query: s.q, Duration: d, Err: err})
+		return err
+	}
+	s.put(ps, c.clock().UnixNano())
+	atomic.AddUint32(c.preparedCount(s), 1)
+	atomic.AddUint64(&c.stats.Prepared, 1)
+	callHook(c.hooks.OnPrepare, Event{Query: s.q, Duration: d})
+	return nil
+}
+
+// preparedCount returns the counter of prepared statements that s is counted in:
+// pinned statements do not count towards the limit set by WithMaxPreparedStmt.
+func (c *sqlStmtCache) preparedCount(s *stmt) *uint32 {
+	if s.isPinned() {
+		return &c.pinnedCount
 	}
-	c.updateHits()
-	c.dropStmts()
+	return &c.psCount
 }
 
-func (c *SQLStmtCache) getCandidates() (victim, replacement *stmt) {
+// unprepare closes the prepared statement of s. It must be called only by the worker.
+func (c *sqlStmtCache) unprepare(s *stmt, reason string) {
+	start := time.Now()
+	s.close()
+	d := time.Since(start)
+	c.latUnprepare.observe(d)
+	atomic.AddUint32(c.preparedCount(s), ^uint32(0))
+	atomic.AddUint64(c.unpreparedCount(), 1)
+	callHook(c.hooks.OnEvict, Event{Query: s.q, Duration: d, Reason: reason, Shadow: c.shadow})
+}
+
+func (c *sqlStmtCache) getCandidates() (victim, replacement *stmt) {
+	now := atomic.LoadInt64(&c.now)
 	c.l.RLock()
 	defer c.l.RUnlock()
 
-	for _, s := range c.stmt {
+	c.stmt.each(func(s *stmt) {
+		if s.isPinned() {
+			return
+		}
 		if s.prepared() {
 			if victim == nil || atomic.LoadUint64(&victim.hit) > atomic.LoadUint64(&s.hit) {
 				victim = s
 			}
-		} else {
+		} else if !s.notPreparable && !s.isBlacklisted(now) {
 			if replacement == nil || atomic.LoadUint64(&replacement.hit) < atomic.LoadUint64(&s.hit) {
 				replacement = s
 			}
 		}
-	}
+	})
 
 	if victim != nil && replacement == nil && atomic.LoadUint64(&victim.hit) > 0 {
 		return nil, nil
@@ -119,63 +479,111 @@ func (c *SQLStmtCache) getCandidates() (victim, replacement *stmt) {
 	return
 }
 
-func (c *SQLStmtCache) updateHits() {
+func (c *sqlStmtCache) updateHits(decay float64) {
 	c.l.RLock()
 	defer c.l.RUnlock()
 
-	for _, s := range c.stmt {
+	c.stmt.each(func(s *stmt) {
 		for {
 			hit := atomic.LoadUint64(&s.hit)
-			if atomic.CompareAndSwapUint64(&s.hit, hit, hit/2) {
+			if atomic.CompareAndSwapUint64(&s.hit, hit, uint64(float64(hit)*decay)) {
 				break
 			}
 		}
+	})
+}
+
+// expireStmts stops tracking, and closes the prepared statements of, all
+// statements that are not pinned and that have not been used in the last idleTTL.
+// Prepared statements are not expired while the cache is frozen (see Freeze).
+func (c *sqlStmtCache) expireStmts(now time.Time) {
+	if c.idleTTL == 0 {
+		return
+	}
+	deadline := now.Add(-c.idleTTL).UnixNano()
+	frozen := atomic.LoadUint32(&c.frozen) != 0
+
+	var expired []*stmt
+	c.l.Lock()
+	c.stmt.each(func(s *stmt) {
+		if s.lastUsed() < deadline && !s.isPinned() && !(frozen && s.prepared()) {
+			expired = append(expired, s)
+		}
+	})
+	for _, s := range expired {
+		c.untrack(s)
 	}
+	c.l.Unlock()
+
+	for _, s := range expired {
+		if s.prepared() {
+			c.unprepare(s, ReasonIdle)
+		}
+		callHook(c.hooks.OnDrop, Event{Query: s.q, Reason: ReasonIdle})
+	}
+	atomic.AddUint64(&c.stats.Expired, uint64(len(expired)))
 }
 
-func (c *SQLStmtCache) dropStmts() {
+// dropStmts stops tracking the least frequently used statements that are not
+// prepared, so that no more than 1/div of maxStmt and of maxBytes is used by
+// them. It returns the number of statements dropped. reason is passed to the
+// OnDrop hook.
+func (c *sqlStmtCache) dropStmts(div int, reason string) int {
 	type _stmt struct {
-		hit uint64
-		q   string
+		hit  uint64
+		s    *stmt
+		size int64
 	}
 
+	targetStmts, targetBytes := int(atomic.LoadInt64(&c.maxStmt))/div, atomic.LoadInt64(&c.maxBytes)/int64(div)
+
 	c.l.RLock()
 
-	if len(c.stmt) < c.maxStmt/2 {
+	if c.stmt.len() < targetStmts && c.trackedBytes < targetBytes {
 		c.l.RUnlock()
-		return
+		return 0
 	}
 
-	stmts := make([]_stmt, len(c.stmt))
-	for q, s := range c.stmt {
+	var bytes int64
+	stmts := make([]_stmt, 0, c.stmt.len())
+	c.stmt.each(func(s *stmt) {
 		if !s.prepared() {
-			stmts = append(stmts, _stmt{hit: atomic.LoadUint64(&s.hit), q: q})
+			stmts = append(stmts, _stmt{hit: atomic.LoadUint64(&s.hit), s: s, size: c.trackedSize(s.q)})
+			bytes += c.trackedSize(s.q)
 		}
-	}
+	})
 
 	c.l.RUnlock()
 
-	victims := len(stmts) - c.maxStmt/2
-
 	sort.Slice(stmts, func(i, j int) bool {
 		return stmts[i].hit < stmts[j].hit
 	})
 
-	// we want to delete also all statements that have 0 hits
-	for _, s := range stmts[victims:] {
-		if s.hit != 0 {
+	victims := 0
+	for n, s := range stmts {
+		// we want to delete also all statements that have 0 hits
+		if len(stmts)-n <= targetStmts && bytes <= targetBytes && s.hit != 0 {
 			break
 		}
+		bytes -= s.size
 		victims++
 	}
 
 	c.l.Lock()
 	for i, s := range stmts[:victims] {
-		delete(c.stmt, s.q)
+		c.untrack(s.s)
 		if i%256 == 255 {
 			c.l.Unlock()
 			c.l.Lock()
 		}
 	}
 	c.l.Unlock()
+
+	if c.hooks.OnDrop != nil {
+		for _, s := range stmts[:victims] {
+			c.hooks.OnDrop(Event{Query: s.s.q, Reason: reason})
+		}
+	}
+
+	return victims
 }
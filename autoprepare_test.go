@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"runtime"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/mattn/go-sqlite3"
@@ -29,19 +32,79 @@ func TestSqlStmtCache(t *testing.T) {
 		panic(err)
 	}
 
-	dbsc, err := New(db)
+	for _, opts := range [][]SQLStmtCacheOpt{nil, {WithHashedKeys()}} {
+		dbsc, err := New(db, opts...)
+		if err != nil {
+			panic(err)
+		}
+
+		ctx := context.Background()
+
+		for i := 0; i < 100000; i++ {
+			res, err := dbsc.QueryContext(ctx, "SELECT * FROM tables")
+			if err != nil {
+				panic(err)
+			}
+			res.Close()
+		}
+		if s := dbsc.GetStats(); s.Hits == 0 || s.TrackedStmts != 1 {
+			t.Errorf("unexpected stats: %+v", s)
+		}
+		dbsc.Close()
+	}
+}
+
+func TestSqlStmtCacheHashedKeys(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
 	if err != nil {
 		panic(err)
 	}
+	defer db.Close()
 
-	ctx := context.Background()
+	dbsc, err := New(db,
+		WithHashedKeys(),
+		WithWarmStart(strings.NewReader(`{"query":"SELECT 2","heat":10}`)),
+		WithPinnedStatements("SELECT 3"),
+		WithWorkerInterval(10*time.Millisecond),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
 
-	for i := 0; i < 100000; i++ {
-		res, err := dbsc.QueryContext(ctx, "SELECT * FROM tables")
-		if err != nil {
+	for i := 0; i < 100 && dbsc.GetStats().PreparedStmts != 3; i++ {
+		if _, err := dbsc.ExecContext(context.Background(), "SELECT 1"); err != nil {
 			panic(err)
 		}
-		res.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := dbsc.Pin(context.Background(), "SELECT 4"); err != nil {
+		t.Fatal(err)
+	}
+	snap := dbsc.Snapshot()
+	if len(snap) != 4 {
+		t.Fatalf("unexpected statements: %+v", snap)
+	}
+	for _, s := range snap {
+		if !s.Prepared || s.Pinned != (s.Query == "SELECT 3" || s.Query == "SELECT 4") {
+			t.Errorf("unexpected statement: %+v", s)
+		}
+	}
+
+	if !dbsc.Invalidate("SELECT 1") || dbsc.Invalidate("SELECT 1") {
+		t.Errorf("unexpected invalidation")
+	}
+	if s := dbsc.GetStats(); s.TrackedStmts != 3 || s.PreparedStmts != 3 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	dbsc.Close()
+	if s := dbsc.GetStats(); s.PreparedStmts != 0 || s.Unprepared != 4 {
+		t.Errorf("unexpected stats: %+v", s)
 	}
 }
 
@@ -82,39 +145,361 @@ func TestSqlStmtCachePollute(t *testing.T) {
 		res.Close()
 	}
 
-	expstmt := make(map[string]struct{})
-	for i := uint32(0); i < dbsc.maxPS; i++ {
-		expstmt[fmt.Sprintf("SELECT * FROM tables WHERE a = %d", i+49)] = struct{}{}
+	// the statements at the edge of the hot set are executed with almost the same
+	// frequency as the ones just outside of it, so which ones end up prepared is
+	// up to chance: only the hottest ones must be prepared, and the ones close to
+	// the edge may be prepared
+	expstmt := make(map[string]bool) // true if the statement must be prepared
+	for i := uint32(0); i < dbsc.maxPS+dbsc.maxPS/4; i++ {
+		expstmt[fmt.Sprintf("SELECT * FROM tables WHERE a = %d", i+49)] = i < dbsc.maxPS-dbsc.maxPS/4
+	}
+
+	// check the statements on the worker, so that it is not in the middle of a run
+	dbsc.run(ctx, func() {
+		dbsc.l.RLock()
+		defer dbsc.l.RUnlock()
+
+		psCount := uint32(0)
+		dbsc.stmt.each(func(s *stmt) {
+			prepared := s.prepared()
+			if prepared {
+				psCount++
+			}
+			must, expected := expstmt[s.q]
+			if prepared && !expected {
+				t.Errorf("unexpected prepared statement %q", s.q)
+			} else if !prepared && must {
+				t.Errorf("missing prepared statement %q", s.q)
+			}
+		})
+		if int64(dbsc.stmt.len()) > dbsc.maxStmt {
+			t.Errorf("too many statements: %d/%d", dbsc.stmt.len(), dbsc.maxStmt)
+		}
+
+		psc := atomic.LoadUint32(&dbsc.psCount)
+		if psc > dbsc.maxPS {
+			t.Errorf("too many prepared statements: %d/%d", psc, dbsc.maxPS)
+		}
+		if psc != psCount {
+			t.Errorf("inconsistent number of prepared statements: count %d, in map %d", psc, psCount)
+		}
+		if psc < dbsc.maxPS {
+			t.Errorf("not enough prepared statements: %d/%d", psc, dbsc.maxPS)
+		}
+	})
+}
+
+func TestSqlStmtCacheWorkerInterval(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS tables (a INT, b TEXT)")
+	if err != nil {
+		panic(err)
+	}
+
+	dbsc, err := New(db, WithWorkerInterval(10*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+
+	ctx := context.Background()
+
+	// far less queries than the worker threshold: only the ticker can prepare the statement
+	for i := 0; i < 10; i++ {
+		res, err := dbsc.QueryContext(ctx, "SELECT * FROM tables")
+		if err != nil {
+			panic(err)
+		}
+		res.Close()
+	}
+
+	for i := 0; i < 100 && atomic.LoadUint32(&dbsc.psCount) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if psc := atomic.LoadUint32(&dbsc.psCount); psc != 1 {
+		t.Errorf("unexpected number of prepared statements: %d", psc)
+	}
+
+	dbsc.Close()
+	select {
+	case <-dbsc.wrkDone:
+	default:
+		t.Errorf("worker still running after Close")
+	}
+	if s := dbsc.GetStats(); s.Prepared != 1 || s.Unprepared != 1 {
+		t.Errorf("unexpected stats after Close: %+v", s)
+	}
+}
+
+func TestSqlStmtCacheIdleTTL(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS tables (a INT, b TEXT)")
+	if err != nil {
+		panic(err)
+	}
+
+	dbsc, err := New(db, WithWorkerInterval(10*time.Millisecond), WithIdleTTL(100*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := context.Background()
+
+	res, err := dbsc.QueryContext(ctx, "SELECT * FROM tables")
+	if err != nil {
+		panic(err)
+	}
+	res.Close()
+
+	// once traffic stops, the statement is first prepared and then released
+	for i := 0; i < 200 && dbsc.GetStats().Expired == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
 	}
 
 	dbsc.l.RLock()
-	defer dbsc.l.RUnlock()
+	n := dbsc.stmt.len()
+	dbsc.l.RUnlock()
+	if n != 0 {
+		t.Errorf("unexpected number of tracked statements: %d", n)
+	}
+	if psc := atomic.LoadUint32(&dbsc.psCount); psc != 0 {
+		t.Errorf("unexpected number of prepared statements: %d", psc)
+	}
+	if s := dbsc.GetStats(); s.Expired != 1 || s.Prepared != 1 || s.Unprepared != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestSqlStmtCacheShrinkOnGC(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
 
-	psCount := uint32(0)
-	for _, s := range dbsc.stmt {
-		prepared := s.prepared()
-		if prepared {
-			psCount++
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS tables (a INT, b TEXT)")
+	if err != nil {
+		panic(err)
+	}
+
+	dbsc, err := New(db, WithShrinkOnGC())
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := context.Background()
+
+	for i := int64(0); i < dbsc.maxStmt; i++ {
+		res, err := dbsc.QueryContext(ctx, fmt.Sprintf("SELECT * FROM tables WHERE a = %d", i))
+		if err != nil {
+			panic(err)
 		}
-		_, expected := expstmt[s.q]
-		if prepared && !expected {
-			t.Errorf("unexpected prepared statement %q", s.q)
-		} else if !prepared && expected {
-			t.Errorf("missing prepared statement %q", s.q)
+		res.Close()
+	}
+
+	// GC cycles during the loop above may have shrunk the table already: wait
+	// for two more shrinks, so that at least one of them starts after the loop
+	shrinks := dbsc.GetStats().Shrinks
+	for i := 0; i < 100 && dbsc.GetStats().Shrinks < shrinks+2; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s := dbsc.GetStats()
+	if s.Shrinks < shrinks+2 || s.Trimmed == 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+	if max := uint64(dbsc.maxStmt/4) + uint64(dbsc.maxPS); s.TrackedStmts > max {
+		t.Errorf("too many statements: %d/%d", s.TrackedStmts, max)
+	}
+}
+
+func TestSqlStmtCacheSoftMemoryLimit(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	if _, err := New(db, WithSoftMemoryLimit(1<<20-1)); err == nil {
+		t.Errorf("invalid soft memory limit accepted")
+	}
+	dbsc, err := New(db, WithSoftMemoryLimit(1<<20))
+	if err != nil {
+		panic(err)
+	}
+	dbsc.Close()
+	if !dbsc.shrinkOnGC || dbsc.softMemLimit != 1<<20 {
+		t.Errorf("soft memory limit not set")
+	}
+
+	// the soft memory limit is set only later, so that GC cycles do not shrink
+	// the cache while the statements are being prepared
+	dbsc, err = New(db, WithMaxPreparedStmt(4), WithWorkerInterval(time.Hour))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := ForcePrepare(context.Background())
+	for i := 1; i <= 4; i++ {
+		for j := 0; j < i; j++ {
+			if _, err := dbsc.ExecContext(ctx, fmt.Sprintf("SELECT %d", i)); err != nil {
+				panic(err)
+			}
 		}
 	}
-	if len(dbsc.stmt) > dbsc.maxStmt {
-		t.Errorf("too many statements: %d/%d", len(dbsc.stmt), dbsc.maxStmt)
+	if s := dbsc.GetStats(); s.PreparedStmts != 4 {
+		t.Fatalf("unexpected stats: %+v", s)
 	}
 
-	psc := atomic.LoadUint32(&dbsc.psCount)
-	if psc > dbsc.maxPS {
-		t.Errorf("too many prepared statements: %d/%d", psc, dbsc.maxPS)
+	// when the heap is bigger than the limit, the least frequently used half
+	// of the prepared statements is closed, even if they are in use
+	dbsc.softMemLimit = 1 << 20
+	dbsc.run(context.Background(), dbsc.shrink)
+	if s := dbsc.GetStats(); s.PreparedStmts != 2 || s.Unprepared != 2 || s.Shrinks != 1 {
+		t.Errorf("unexpected stats: %+v", s)
 	}
-	if psc != psCount {
-		t.Errorf("inconsistent number of prepared statements: count %d, in map %d", psc, psCount)
+	for _, st := range dbsc.Snapshot() {
+		if want := st.Query == "SELECT 3" || st.Query == "SELECT 4"; st.Prepared != want {
+			t.Errorf("unexpected statement: %+v", st)
+		}
+	}
+}
+
+func TestSqlStmtCacheMaxTrackedBytes(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS tables (a INT, b TEXT)")
+	if err != nil {
+		panic(err)
+	}
+
+	const maxBytes = 1 << 16
+	dbsc, err := New(db, WithMaxTrackedBytes(maxBytes))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := context.Background()
+
+	pad := strings.Repeat(" ", 2000)
+	for i := 0; i < 1000; i++ {
+		res, err := dbsc.QueryContext(ctx, fmt.Sprintf("SELECT * FROM tables WHERE a = %d%s", i, pad))
+		if err != nil {
+			panic(err)
+		}
+		res.Close()
+	}
+
+	dbsc.l.RLock()
+	n := dbsc.stmt.len()
+	dbsc.l.RUnlock()
+	if max := maxBytes / len(pad); n > max {
+		t.Errorf("too many statements: %d/%d", n, max)
+	}
+	if b := dbsc.GetStats().TrackedBytes; b > maxBytes || b == 0 {
+		t.Errorf("unexpected tracked bytes: %d/%d", b, maxBytes)
+	}
+}
+
+func TestSqlStmtCacheReasons(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS tables (a INT, b TEXT)")
+	if err != nil {
+		panic(err)
+	}
+
+	dbsc, err := New(db, WithMaxStmt(128), WithMaxQueryLen(64), WithDenyRules(PrefixRule("SAVEPOINT", "RELEASE")))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := context.Background()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	exec := func(ctx context.Context, query string) {
+		dbsc.ExecContext(ctx, query)
+	}
+	exec(ctx, "SAVEPOINT x")
+	exec(ctx, "  release x")
+	for i := 0; i < 200; i++ {
+		exec(ctx, fmt.Sprintf("SELECT * FROM tables WHERE a = %d", i))
+	}
+	exec(ctx, "SELECT * FROM tables WHERE b = '"+strings.Repeat("x", 64)+"'")
+	exec(canceled, "SELECT * FROM tables")
+	exec(ctx, "SELECT * FROM tables WHERE a = 0")
+
+	s := dbsc.GetStats()
+	exp := SQLStmtCacheStats{
+		Misses:        205,
+		Skips:         1,
+		TooLong:       1,
+		TableFull:     200 - 126,
+		NotHot:        126 + 1,
+		NotPreparable: 2,
+		Canceled:      1,
+		TrackedStmts:  128,
+		TrackedBytes:  s.TrackedBytes,
+	}
+	if s != exp {
+		t.Errorf("unexpected stats:\n got %+v\nwant %+v", s, exp)
+	}
+
+	dbsc2, err := New(db, WithMaxPreparedStmt(0))
+	if err != nil {
+		panic(err)
 	}
-	if psc < dbsc.maxPS {
-		t.Errorf("not enough prepared statements: %d/%d", psc, dbsc.maxPS)
+	defer dbsc2.Close()
+	dbsc2.ExecContext(ctx, "SELECT * FROM tables")
+	if s := dbsc2.GetStats(); s.Disabled != 1 || s.Misses != 1 {
+		t.Errorf("unexpected stats: %+v", s)
 	}
 }
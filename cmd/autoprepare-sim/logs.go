@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logParsers contains the parsers of the query logs supported by -log-format.
+// Each parser returns the queries contained in the log, in the order they
+// appear in it.
+var logParsers = map[string]func(io.Reader) ([]query, error){
+	"mysql-general": parseMySQLGeneralLog,
+	"mysql-slow":    parseMySQLSlowLog,
+	"postgres":      parsePostgresLog,
+}
+
+// mysqlGeneralRe matches the first line of an entry of the MySQL general query
+// log: the time (omitted by MySQL 5.x if it is the same as the previous entry),
+// the connection id, the command and its argument.
+var mysqlGeneralRe = regexp.MustCompile(`^(\S+Z|\d{6} [ \d]\d:\d\d:\d\d|)\s+(\d+) ` +
+	`(Query|Execute|Prepare|Close stmt|Reset stmt|Fetch|Connect|Quit|Init DB|Field List|Change user|Set option|Statistics|Ping|Processlist|Kill|Refresh|Debug|Shutdown|Binlog Dump)` +
+	`(?:\t(.*))?$`)
+
+// parseMySQLGeneralLog parses a MySQL general query log (general_log_file).
+// Only the Query commands are considered.
+func parseMySQLGeneralLog(r io.Reader) ([]query, error) {
+	var qs []query
+	var t time.Time
+	inQuery := false
+	sc := newScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		l := sc.Text()
+		m := mysqlGeneralRe.FindStringSubmatch(l)
+		if m == nil {
+			// continuation of a multi-line query, or header
+			if inQuery {
+				qs[len(qs)-1].q += "\n" + l
+			}
+			continue
+		}
+		if m[1] != "" {
+			var err error
+			if t, err = parseMySQLTime(m[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		inQuery = m[3] == "Query"
+		if inQuery {
+			qs = append(qs, query{t: t, q: m[4]})
+		}
+	}
+	return qs, sc.Err()
+}
+
+// parseMySQLSlowLog parses a MySQL slow query log (slow_query_log_file). To
+// include all queries, long_query_time must be set to 0.
+func parseMySQLSlowLog(r io.Reader) ([]query, error) {
+	var qs []query
+	var cur query
+	var stmt []string
+	var nsec int64 // fractional seconds of the "# Time:" line of the current entry
+	flush := func() {
+		if len(stmt) > 0 {
+			cur.q = strings.TrimSuffix(strings.Join(stmt, "\n"), ";")
+			qs = append(qs, cur)
+			stmt = nil
+			// entries without a "# Time:" line keep the time of the previous
+			// one, unless they have a "SET timestamp=" line
+			cur.dur, nsec = 0, 0
+		}
+	}
+	sc := newScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		l := sc.Text()
+		switch {
+		case strings.HasPrefix(l, "# Time: "):
+			flush()
+			t, err := parseMySQLTime(strings.TrimSpace(strings.TrimPrefix(l, "# Time: ")))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			cur.t, nsec = t, int64(t.Nanosecond())
+		case strings.HasPrefix(l, "# User@Host: "):
+			flush()
+		case strings.HasPrefix(l, "# Query_time: "):
+			f := strings.Fields(l)
+			if len(f) < 3 {
+				break // truncated line
+			}
+			if secs, err := strconv.ParseFloat(f[2], 64); err == nil {
+				cur.dur = time.Duration(secs * float64(time.Second))
+			}
+		case strings.HasPrefix(l, "#"):
+			// other header lines
+		case strings.HasPrefix(l, "SET timestamp=") && len(stmt) == 0:
+			if secs, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(l, "SET timestamp="), ";"), 10, 64); err == nil {
+				cur.t = time.Unix(secs, nsec).UTC()
+			}
+		case strings.HasPrefix(strings.ToLower(l), "use ") && strings.HasSuffix(l, ";") && len(stmt) == 0:
+			// current database
+		case strings.HasPrefix(l, "/usr/") || strings.HasPrefix(l, "Tcp port:") || strings.HasPrefix(l, "Time "):
+			// header written when the log is opened
+		default:
+			stmt = append(stmt, l)
+		}
+	}
+	flush()
+	return qs, sc.Err()
+}
+
+func parseMySQLTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "060102 15:04:05"} {
+		// MySQL 5.x pads the hour with a space
+		if t, err := time.Parse(layout, strings.Join(strings.Fields(s), " ")); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// postgresRe matches the lines of the PostgreSQL log containing a statement,
+// logged because of log_statement or log_min_duration_statement. Statements
+// executed using named prepared statements are not considered.
+var postgresRe = regexp.MustCompile(`^(.*?)\bLOG:  (?:duration: ([\d.]+) ms  )?(?:statement|execute <unnamed>): (.*)$`)
+
+// postgresLogRe matches the other lines of the PostgreSQL log.
+var postgresLogRe = regexp.MustCompile(`\b[A-Z]+:  `)
+
+// parsePostgresLog parses a PostgreSQL log written with log_statement = 'all'
+// (or log_min_duration_statement = 0). The time of each statement is parsed
+// from the beginning of log_line_prefix (%m or %t); if it is missing, the time
+// of the previous statement is used.
+func parsePostgresLog(r io.Reader) ([]query, error) {
+	var qs []query
+	var t time.Time
+	inQuery := false
+	sc := newScanner(r)
+	for sc.Scan() {
+		l := sc.Text()
+		m := postgresRe.FindStringSubmatch(l)
+		if m == nil {
+			// multi-line statements are continued on lines starting with a tab
+			if inQuery && (strings.HasPrefix(l, "\t") || !postgresLogRe.MatchString(l)) {
+				qs[len(qs)-1].q += "\n" + strings.TrimPrefix(l, "\t")
+			} else {
+				inQuery = false
+			}
+			continue
+		}
+		if pt, ok := parsePostgresTime(m[1]); ok {
+			t = pt
+		}
+		q := query{t: t, q: m[3]}
+		if ms, err := strconv.ParseFloat(m[2], 64); err == nil {
+			q.dur = time.Duration(ms * float64(time.Millisecond))
+		}
+		qs = append(qs, q)
+		inQuery = true
+	}
+	return qs, sc.Err()
+}
+
+func parsePostgresTime(prefix string) (time.Time, bool) {
+	f := strings.Fields(prefix)
+	if len(f) < 2 {
+		return time.Time{}, false
+	}
+	s := f[0] + " " + f[1]
+	if len(f) >= 3 {
+		s += " " + f[2]
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05.999 MST", "2006-01-02 15:04:05 MST", "2006-01-02 15:04:05.999", "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+		// the time zone may be missing, so try without the third field
+		if t, err := time.Parse(layout, f[0]+" "+f[1]); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func newScanner(r io.Reader) *bufio.Scanner {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 16<<20) // queries can be long
+	return sc
+}
+
+// normalizeQuery replaces the string and numeric literals in q with placeholders, to
+// estimate the workload if the application used placeholders for them. Double
+// quotes delimit identifiers, as in standard SQL.
+func normalizeQuery(q string) string {
+	var sb strings.Builder
+	sb.Grow(len(q))
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == '\'':
+			// string literal; quotes are escaped by doubling them
+			j := i + 1
+			for j < len(q) {
+				if q[j] == '\\' && j+1 < len(q) {
+					j += 2
+					continue
+				}
+				if q[j] == '\'' {
+					if j+1 < len(q) && q[j+1] == '\'' {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			sb.WriteByte('?')
+			i = j + 1
+		case c == '"' || c == '`':
+			// quoted identifier
+			end := len(q)
+			if j := strings.IndexByte(q[i+1:], c); j >= 0 {
+				end = i + j + 2
+			}
+			sb.WriteString(q[i:end])
+			i = end
+		case isDigit(c) && (i == 0 || !isIdent(q[i-1])):
+			j := i + 1
+			for j < len(q) && (isIdent(q[j]) || q[j] == '.' ||
+				((q[j] == '+' || q[j] == '-') && (q[j-1] == 'e' || q[j-1] == 'E'))) {
+				j++
+			}
+			sb.WriteByte('?')
+			i = j
+		default:
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	return sb.String()
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+func isIdent(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' || c >= 0x80
+}
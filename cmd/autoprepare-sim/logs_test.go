@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMySQLGeneralLog(t *testing.T) {
+	const log = `/usr/sbin/mysqld, Version: 8.0.35 (MySQL Community Server - GPL). started with:
+Tcp port: 3306  Unix socket: /var/run/mysqld/mysqld.sock
+Time                 Id Command    Argument
+2024-01-02T10:00:00.123456Z	   12 Connect	root@localhost on test using Socket
+2024-01-02T10:00:00.223456Z	   12 Query	SELECT * FROM t WHERE id = 1
+2024-01-02T10:00:01.000000Z	   12 Query	SELECT *
+FROM t
+  WHERE id = 2
+2024-01-02T10:00:02.000000Z	   12 Quit	
+240102 10:00:03	    1 Query	SELECT 3
+		    1 Query	SELECT 4
+240102  9:00:05	    1 Init DB	test
+`
+	qs, err := parseMySQLGeneralLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []query{
+		{t: time.Date(2024, 1, 2, 10, 0, 0, 223456000, time.UTC), q: "SELECT * FROM t WHERE id = 1"},
+		{t: time.Date(2024, 1, 2, 10, 0, 1, 0, time.UTC), q: "SELECT *\nFROM t\n  WHERE id = 2"},
+		{t: time.Date(2024, 1, 2, 10, 0, 3, 0, time.UTC), q: "SELECT 3"},
+		{t: time.Date(2024, 1, 2, 10, 0, 3, 0, time.UTC), q: "SELECT 4"},
+	}
+	if !reflect.DeepEqual(qs, exp) {
+		t.Errorf("unexpected queries:\ngot  %+v\nwant %+v", qs, exp)
+	}
+}
+
+func TestParseMySQLSlowLog(t *testing.T) {
+	const log = `/usr/sbin/mysqld, Version: 8.0.35 (MySQL Community Server - GPL). started with:
+Tcp port: 3306  Unix socket: /var/run/mysqld/mysqld.sock
+Time                 Id Command    Argument
+# Time: 2024-01-02T10:00:00.123456Z
+# User@Host: root[root] @ localhost []  Id:    12
+# Query_time: 0.000250  Lock_time: 0.000001 Rows_sent: 1  Rows_examined: 1
+use test;
+SET timestamp=1704189600;
+SELECT * FROM t WHERE id = 1;
+# User@Host: root[root] @ localhost []  Id:    12
+# Query_time: 1.500000  Lock_time: 0.000001 Rows_sent: 1  Rows_examined: 1
+SET timestamp=1704189601;
+SELECT *
+FROM t;
+# User@Host: root[root] @ localhost []  Id:    12
+# Query_time:
+SELECT 2;
+`
+	qs, err := parseMySQLSlowLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []query{
+		{t: time.Date(2024, 1, 2, 10, 0, 0, 123456000, time.UTC), q: "SELECT * FROM t WHERE id = 1", dur: 250 * time.Microsecond},
+		{t: time.Date(2024, 1, 2, 10, 0, 1, 0, time.UTC), q: "SELECT *\nFROM t", dur: 1500 * time.Millisecond},
+		{t: time.Date(2024, 1, 2, 10, 0, 1, 0, time.UTC), q: "SELECT 2"},
+	}
+	if !reflect.DeepEqual(qs, exp) {
+		t.Errorf("unexpected queries:\ngot  %+v\nwant %+v", qs, exp)
+	}
+}
+
+func TestParsePostgresLog(t *testing.T) {
+	const log = `2024-01-02 10:00:00.123 UTC [12345] LOG:  statement: SELECT * FROM t WHERE id = 1
+2024-01-02 10:00:01.000 UTC [12345] LOG:  execute <unnamed>: SELECT * FROM t WHERE id = $1
+2024-01-02 10:00:01.000 UTC [12345] DETAIL:  parameters: $1 = '2'
+2024-01-02 10:00:02.000 UTC [12345] LOG:  execute S_1: SELECT 1
+2024-01-02 10:00:03.000 UTC [12345] LOG:  duration: 0.250 ms  statement: SELECT *
+	FROM t
+2024-01-02 10:00:04 UTC [12345] LOG:  connection received: host=[local]
+[12346] LOG:  statement: SELECT 5
+`
+	qs, err := parsePostgresLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []query{
+		{t: time.Date(2024, 1, 2, 10, 0, 0, 123000000, time.UTC), q: "SELECT * FROM t WHERE id = 1"},
+		{t: time.Date(2024, 1, 2, 10, 0, 1, 0, time.UTC), q: "SELECT * FROM t WHERE id = $1"},
+		{t: time.Date(2024, 1, 2, 10, 0, 3, 0, time.UTC), q: "SELECT *\nFROM t", dur: 250 * time.Microsecond},
+		{t: time.Date(2024, 1, 2, 10, 0, 3, 0, time.UTC), q: "SELECT 5"},
+	}
+	if !reflect.DeepEqual(qs, exp) {
+		t.Errorf("unexpected queries:\ngot  %+v\nwant %+v", qs, exp)
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	for q, exp := range map[string]string{
+		"SELECT * FROM t WHERE id = 1":                    "SELECT * FROM t WHERE id = ?",
+		"SELECT * FROM t2 WHERE a IN (1, -2.5e-3, 0x1F)":  "SELECT * FROM t2 WHERE a IN (?, -?, ?)",
+		"SELECT 'it''s', 'a\\'b', \"col1\" FROM `t 1`":    "SELECT ?, ?, \"col1\" FROM `t 1`",
+		"SELECT * FROM t WHERE id = $1 AND x = 'unclosed": "SELECT * FROM t WHERE id = $1 AND x = ?",
+	} {
+		if got := normalizeQuery(q); got != exp {
+			t.Errorf("normalizeQuery(%q): got %q, want %q", q, got, exp)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+// Command autoprepare-sim replays a workload through the policy used by
+// autoprepare to pick the statements to prepare, without a database, and
+// reports how effective the cache would be with different configurations.
+//
+// The workload is either a trace recorded with autoprepare.WithTraceRecorder
+// (-trace), a query log of the database server (-log), or a synthetic workload
+// (-workload):
+//
+//	zipf     the popularity of the queries follows a Zipf distribution
+//	bursty   like zipf, but periodically a burst of queries that are executed
+//	         only once (e.g. a batch job) is added to the workload
+//
+// The supported query logs (-log-format) are:
+//
+//	mysql-general  MySQL general query log
+//	mysql-slow     MySQL slow query log, with long_query_time = 0
+//	postgres       PostgreSQL log, with log_statement = 'all' or log_min_duration_statement = 0
+//
+// If the application does not use placeholders for all the arguments of its
+// queries, the literals in the queries can be replaced by placeholders with
+// -normalize, to estimate the effect of using placeholders. Query logs can be
+// converted to traces with -write-trace.
+//
+// All combinations of the values of -max-ps, -max-stmt and -threshold are
+// simulated, e.g.:
+//
+//	autoprepare-sim -workload zipf -max-ps 8,16,32 -threshold 1000,5000
+//	autoprepare-sim -trace trace.jsonl -max-ps 16,64 -v
+//
+// With -recommend, a range of values of -max-ps and -max-stmt is simulated
+// instead, and the cheapest configuration with a hit ratio close to the best one
+// is recommended, together with the statements that would be prepared, e.g.:
+//
+//	autoprepare-sim -log mysql.log -log-format mysql-general -normalize -recommend
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/CAFxX/autoprepare"
+)
+
+var (
+	tracePath  = flag.String("trace", "", "trace recorded with WithTraceRecorder (- for stdin)")
+	workload   = flag.String("workload", "zipf", "synthetic workload, if neither -trace nor -log are used: zipf or bursty")
+	queries    = flag.Int("queries", 1000000, "number of queries of the synthetic workload")
+	distinct   = flag.Int("distinct", 10000, "number of distinct queries of the synthetic workload")
+	qps        = flag.Float64("qps", 1000, "queries per second of the synthetic workload")
+	zipfS      = flag.Float64("zipf-s", 1.1, "exponent of the Zipf distribution (> 1)")
+	burstEvery = flag.Duration("burst-every", 10*time.Minute, "interval between the bursts of the bursty workload")
+	burstLen   = flag.Duration("burst-len", time.Minute, "duration of the bursts of the bursty workload")
+	burstFrac  = flag.Float64("burst-frac", 0.5, "fraction of the queries, during the bursts, that are executed only once")
+	seed       = flag.Int64("seed", 1, "seed of the synthetic workload")
+
+	logPath   = flag.String("log", "", "query log of the database server (- for stdin)")
+	logFormat = flag.String("log-format", "mysql-general", "format of -log: mysql-general, mysql-slow or postgres")
+	normalize = flag.Bool("normalize", false, "replace the literals in the queries with placeholders")
+	traceOut  = flag.String("write-trace", "", "write the workload to this file, in the format of WithTraceRecorder")
+
+	maxPS     = flag.String("max-ps", strconv.Itoa(autoprepare.DefaultMaxPreparedStmt), "comma-separated values of WithMaxPreparedStmt")
+	maxStmt   = flag.String("max-stmt", strconv.Itoa(autoprepare.DefaultMaxStmt), "comma-separated values of WithMaxStmt")
+	threshold = flag.String("threshold", strconv.Itoa(autoprepare.DefaultWorkerThreshold), "comma-separated values of WithWorkerThreshold")
+	interval  = flag.Duration("interval", autoprepare.DefaultSimReportInterval, "length of the intervals of the hit ratio over time")
+	verbose   = flag.Bool("v", false, "report the hit ratio over time")
+	recommend = flag.Bool("recommend", false, "recommend a configuration, and list the statements that would be prepared")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "autoprepare-sim:", err)
+		os.Exit(1)
+	}
+}
+
+// query is a query of the workload.
+type query struct {
+	t   time.Time
+	q   string
+	dur time.Duration // if known
+}
+
+func run(w io.Writer) error {
+	var wl []query
+	var err error
+	switch {
+	case *tracePath != "":
+		wl, err = readTrace(*tracePath)
+	case *logPath != "":
+		wl, err = readLog(*logPath, *logFormat)
+	default:
+		wl, err = synthetic()
+	}
+	if err != nil {
+		return err
+	}
+	if len(wl) == 0 {
+		return errors.New("empty workload")
+	}
+	if *normalize {
+		for i := range wl {
+			wl[i].q = normalizeQuery(wl[i].q)
+		}
+	}
+	if *traceOut != "" {
+		if err := writeTrace(*traceOut, wl); err != nil {
+			return err
+		}
+	}
+
+	maxPSs, err := parseInts(*maxPS)
+	if err != nil {
+		return fmt.Errorf("-max-ps: %w", err)
+	}
+	maxStmts, err := parseInts(*maxStmt)
+	if err != nil {
+		return fmt.Errorf("-max-stmt: %w", err)
+	}
+	thresholds, err := parseInts(*threshold)
+	if err != nil {
+		return fmt.Errorf("-threshold: %w", err)
+	}
+
+	if *recommend {
+		// the values of -max-ps and -max-stmt are ignored
+		maxPSs = []int{4, 8, 16, 32, 64, 128, 256}
+		maxStmts = []int{256, 1024, 4096, 16384}
+		thresholds = thresholds[:1]
+	}
+
+	fmt.Fprintf(w, "%d queries over %v\n\n", len(wl), wl[len(wl)-1].t.Sub(wl[0].t))
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "max-ps\tmax-stmt\tthreshold\thit ratio\twarm-up\tprepared\tunprepared\tpeak stmts\tpeak bytes\t")
+	var results []result
+	for _, ps := range maxPSs {
+		for _, stmt := range maxStmts {
+			for _, th := range thresholds {
+				sim, err := simulate(wl, ps, stmt, th)
+				if err != nil {
+					return err
+				}
+				r := sim.Report()
+				sim.Close()
+				results = append(results, result{maxPS: ps, maxStmt: stmt, threshold: th, report: r})
+				fmt.Fprintf(tw, "%d\t%d\t%d\t%.1f%%\t%v\t%d\t%d\t%d\t%d\t\n",
+					ps, stmt, th, r.HitRatio()*100, r.WarmUp, r.Prepared, r.Unprepared, r.PeakTrackedStmts, r.PeakTrackedBytes)
+			}
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if *verbose {
+		for _, res := range results {
+			fmt.Fprint(w, "\n", timeline(res))
+		}
+	}
+	if *recommend {
+		return recommendConfig(w, wl, results)
+	}
+	return nil
+}
+
+// result is the result of the simulation of a configuration.
+type result struct {
+	maxPS, maxStmt, threshold int
+	report                    autoprepare.SimReport
+}
+
+// recommendConfig writes the cheapest configuration, i.e. the one with the
+// fewest prepared and tracked statements, whose hit ratio is no more than 1
+// percentage point lower than the best one, and the statements that would be
+// prepared at the end of the workload.
+func recommendConfig(w io.Writer, wl []query, results []result) error {
+	var best float64
+	for _, res := range results {
+		if hr := res.report.HitRatio(); hr > best {
+			best = hr
+		}
+	}
+	var rec *result
+	for i := range results {
+		res := &results[i]
+		if res.report.HitRatio() < best-0.01 {
+			continue
+		}
+		if rec == nil || res.maxPS < rec.maxPS || (res.maxPS == rec.maxPS && res.maxStmt < rec.maxStmt) {
+			rec = res
+		}
+	}
+
+	fmt.Fprintf(w, "\nrecommended configuration (hit ratio %.1f%%):\n\n", rec.report.HitRatio()*100)
+	fmt.Fprintf(w, "\tautoprepare.WithMaxPreparedStmt(%d),\n\tautoprepare.WithMaxStmt(%d),\n\tautoprepare.WithWorkerThreshold(%d),\n", rec.maxPS, rec.maxStmt, rec.threshold)
+
+	sim, err := simulate(wl, rec.maxPS, rec.maxStmt, rec.threshold)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	fmt.Fprintf(w, "\nstatements that would be prepared:\n\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "heat\thits\tquery")
+	for _, st := range sim.Statements() {
+		if st.Prepared {
+			fmt.Fprintf(tw, "%d\t%d\t%s\n", st.Heat, st.Hits, strings.Join(strings.Fields(st.Query), " "))
+		}
+	}
+	return tw.Flush()
+}
+
+func simulate(wl []query, maxPS, maxStmt, threshold int) (*autoprepare.Simulator, error) {
+	sim, err := autoprepare.NewSimulator(autoprepare.SimOptions{
+		Options: []autoprepare.SQLStmtCacheOpt{
+			autoprepare.WithMaxPreparedStmt(maxPS),
+			autoprepare.WithMaxStmt(maxStmt),
+			autoprepare.WithWorkerThreshold(threshold),
+		},
+		ReportInterval: *interval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range wl {
+		sim.Query(q.t, q.q)
+	}
+	return sim, nil
+}
+
+func timeline(res result) string {
+	var sb strings.Builder
+	r := res.report
+	fmt.Fprintf(&sb, "max-ps=%d max-stmt=%d threshold=%d\n", res.maxPS, res.maxStmt, res.threshold)
+	for _, i := range r.Intervals {
+		fmt.Fprintf(&sb, "%10v %6.1f%% %s\n", i.Start.Sub(r.Start), i.HitRatio()*100, strings.Repeat("#", int(i.HitRatio()*50+0.5)))
+	}
+	return sb.String()
+}
+
+// readTrace reads a trace in the format written by WithTraceRecorder. As traces
+// do not contain the text of the queries, each query is replaced by a string of
+// the same length, derived from its fingerprint.
+func readTrace(path string) ([]query, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	texts := map[autoprepare.TraceRecord]string{}
+	var wl []query
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		var rec autoprepare.TraceRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		key := autoprepare.TraceRecord{Fingerprint: rec.Fingerprint, Len: rec.Len}
+		q, ok := texts[key]
+		if !ok {
+			q = rec.Fingerprint
+			if rec.Len > len(q) {
+				q += strings.Repeat(" ", rec.Len-len(q))
+			}
+			texts[key] = q
+		}
+		wl = append(wl, query{t: time.Unix(0, rec.Time), q: q, dur: time.Duration(rec.Duration)})
+	}
+	return wl, sc.Err()
+}
+
+// readLog reads a query log of the database server, in the specified format.
+func readLog(path, format string) ([]query, error) {
+	parse := logParsers[format]
+	if parse == nil {
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	wl, err := parse(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return wl, nil
+}
+
+// writeTrace writes wl to path, in the format written by WithTraceRecorder.
+func writeTrace(path string, wl []query) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	for _, q := range wl {
+		err := enc.Encode(autoprepare.TraceRecord{
+			Time:        q.t.UnixNano(),
+			Fingerprint: autoprepare.Fingerprint(q.q),
+			Len:         len(q.q),
+			Duration:    int64(q.dur),
+		})
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// synthetic generates the synthetic workload selected by the flags.
+func synthetic() ([]query, error) {
+	if *queries <= 0 || *distinct <= 0 || *qps <= 0 {
+		return nil, errors.New("-queries, -distinct and -qps should be more than 0")
+	}
+	if *zipfS <= 1 {
+		return nil, errors.New("-zipf-s should be more than 1")
+	}
+	bursty := false
+	switch *workload {
+	case "zipf":
+	case "bursty":
+		bursty = true
+		if *burstEvery <= 0 || *burstLen <= 0 || *burstLen > *burstEvery || *burstFrac < 0 || *burstFrac > 1 {
+			return nil, errors.New("invalid burst parameters")
+		}
+	default:
+		return nil, fmt.Errorf("unknown workload %q", *workload)
+	}
+
+	rnd := rand.New(rand.NewSource(*seed))
+	zipf := rand.NewZipf(rnd, *zipfS, 1, uint64(*distinct-1))
+	start := time.Unix(0, 0).UTC()
+	step := time.Duration(float64(time.Second) / *qps)
+	wl := make([]query, *queries)
+	oneOff := 0
+	for i := range wl {
+		t := start.Add(time.Duration(i) * step)
+		var q string
+		if bursty && t.Sub(start)%*burstEvery < *burstLen && rnd.Float64() < *burstFrac {
+			q = fmt.Sprintf("SELECT * FROM batch WHERE id = %d", oneOff)
+			oneOff++
+		} else {
+			q = fmt.Sprintf("SELECT * FROM t%d WHERE id = ?", zipf.Uint64())
+		}
+		wl[i] = query{t: t, q: q}
+	}
+	return wl, nil
+}
+
+func parseInts(s string) ([]int, error) {
+	var r []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, n)
+	}
+	return r, nil
+}
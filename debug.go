@@ -0,0 +1,171 @@
+package autoprepare
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// debugInfo is the information exposed by PublishExpvar and DebugHandler.
+type debugInfo struct {
+	Stats      SQLStmtCacheStats
+	Statements []StmtStats
+}
+
+func (c *SQLStmtCache) debugInfo() debugInfo {
+	return debugInfo{
+		Stats:      c.GetStats(),
+		Statements: c.Snapshot(),
+	}
+}
+
+// PublishExpvar publishes, using expvar, the statistics returned by GetStats and
+// Snapshot under the specified name. Like expvar.Publish, it panics if the name
+// is already in use. As expvar variables can not be removed, publishing the cache
+// prevents it from being garbage collected: Close must be called explicitly.
+func (c *SQLStmtCache) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return c.debugInfo()
+	}))
+}
+
+// DebugHandler returns an http.Handler that, similarly to net/http/pprof, allows
+// to inspect the cache at runtime.
+//
+// GET requests return the statistics returned by GetStats and the statements
+// returned by Snapshot. They are rendered as HTML, unless the request contains
+// the format=json query parameter or accepts application/json, in which case
+// they are rendered as JSON.
+//
+// POST requests containing the form values action (either "invalidate", "pin" or
+// "unpin") and query call respectively Invalidate, Pin or Unpin for the specified
+// query.
+//
+// The handler does not perform any authentication, so it should be exposed only
+// to trusted clients.
+func (c *SQLStmtCache) DebugHandler() http.Handler {
+	return debugHandler{c}
+}
+
+type debugHandler struct {
+	c *SQLStmtCache
+}
+
+func (h debugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wantJSON := r.FormValue("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		info := h.c.debugInfo()
+		if wantJSON {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(info)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		debugTemplate.Execute(w, info)
+
+	case http.MethodPost:
+		query := r.FormValue("query")
+		if query == "" {
+			http.Error(w, "missing query", http.StatusBadRequest)
+			return
+		}
+		switch action := r.FormValue("action"); action {
+		case "invalidate":
+			h.c.Invalidate(query)
+		case "pin":
+			if err := h.c.Pin(r.Context(), query); err != nil {
+				status := http.StatusInternalServerError
+				if errors.Is(err, errTooLong) || errors.Is(err, errNotPreparable) || errors.Is(err, errTooManyPinned) {
+					status = http.StatusBadRequest
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+		case "unpin":
+			h.c.Unpin(query)
+		default:
+			http.Error(w, "unknown action "+action, http.StatusBadRequest)
+			return
+		}
+		if wantJSON {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>autoprepare</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+td.q { font-family: monospace; white-space: pre-wrap; max-width: 60em; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>autoprepare</h1>
+<h2>Statistics</h2>
+<table>
+{{with .Stats}}
+<tr><th>Hits</th><td>{{.Hits}}</td></tr>
+<tr><th>Misses</th><td>{{.Misses}}</td></tr>
+<tr><th>Skips</th><td>{{.Skips}}</td></tr>
+<tr><th>Prepared</th><td>{{.Prepared}}</td></tr>
+<tr><th>Unprepared</th><td>{{.Unprepared}}</td></tr>
+<tr><th>Expired</th><td>{{.Expired}}</td></tr>
+<tr><th>Shrinks</th><td>{{.Shrinks}}</td></tr>
+<tr><th>Trimmed</th><td>{{.Trimmed}}</td></tr>
+<tr><th>WouldPrepare</th><td>{{.WouldPrepare}}</td></tr>
+<tr><th>WouldUnprepare</th><td>{{.WouldUnprepare}}</td></tr>
+<tr><th>TraceDropped</th><td>{{.TraceDropped}}</td></tr>
+<tr><th>Disabled</th><td>{{.Disabled}}</td></tr>
+<tr><th>TooLong</th><td>{{.TooLong}}</td></tr>
+<tr><th>TableFull</th><td>{{.TableFull}}</td></tr>
+<tr><th>NotHot</th><td>{{.NotHot}}</td></tr>
+<tr><th>Blacklisted</th><td>{{.Blacklisted}}</td></tr>
+<tr><th>NotPreparable</th><td>{{.NotPreparable}}</td></tr>
+<tr><th>Canceled</th><td>{{.Canceled}}</td></tr>
+<tr><th>Bypassed</th><td>{{.Bypassed}}</td></tr>
+<tr><th>WouldHit</th><td>{{.WouldHit}}</td></tr>
+<tr><th>Paused</th><td>{{.Paused}}</td></tr>
+<tr><th>TrackedStmts</th><td>{{.TrackedStmts}}</td></tr>
+<tr><th>PreparedStmts</th><td>{{.PreparedStmts}}</td></tr>
+<tr><th>PinnedStmts</th><td>{{.PinnedStmts}}</td></tr>
+<tr><th>TrackedBytes</th><td>{{.TrackedBytes}}</td></tr>
+{{end}}
+</table>
+<h2>Statements</h2>
+<table>
+<tr><th>Query</th><th>Heat</th><th>Hits</th><th>Misses</th><th>Prepared</th><th>Prepare errors</th><th>Actions</th></tr>
+{{range .Statements}}
+<tr>
+<td class="q">{{.Query}}</td>
+<td>{{.Heat}}</td>
+<td>{{.Hits}}</td>
+<td>{{.Misses}}</td>
+<td>{{if .Prepared}}since {{.PreparedAt.Format "2006-01-02 15:04:05"}}{{if .Pinned}} (pinned){{end}}{{else if .NotPreparable}}not preparable{{else if .Blacklisted}}blacklisted{{else}}no{{end}}</td>
+<td>{{.PrepareErrors}}{{with .LastPrepareError}}: {{.}}{{end}}</td>
+<td>
+<form method="POST"><input type="hidden" name="action" value="invalidate"><input type="hidden" name="query" value="{{.Query}}"><button>Invalidate</button></form>
+{{if not .Pinned}}<form method="POST"><input type="hidden" name="action" value="pin"><input type="hidden" name="query" value="{{.Query}}"><button>Pin</button></form>{{else}}<form method="POST"><input type="hidden" name="action" value="unpin"><input type="hidden" name="query" value="{{.Query}}"><button>Unpin</button></form>{{end}}
+</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
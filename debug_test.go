@@ -0,0 +1,113 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS tables (a INT, b TEXT)")
+	if err != nil {
+		panic(err)
+	}
+
+	dbsc, err := New(db)
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	const query = "SELECT * FROM tables WHERE a < 1"
+	res, err := dbsc.QueryContext(context.Background(), query)
+	if err != nil {
+		panic(err)
+	}
+	res.Close()
+
+	srv := httptest.NewServer(dbsc.DebugHandler())
+	defer srv.Close()
+
+	get := func(url string) string {
+		res, err := http.Get(url)
+		if err != nil {
+			panic(err)
+		}
+		defer res.Body.Close()
+		buf, err := io.ReadAll(res.Body)
+		if err != nil {
+			panic(err)
+		}
+		return string(buf)
+	}
+	postQuery := func(action, query string) int {
+		res, err := http.PostForm(srv.URL+"?format=json", url.Values{"action": {action}, "query": {query}})
+		if err != nil {
+			panic(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	post := func(action string) {
+		if status := postQuery(action, query); status != http.StatusNoContent {
+			t.Fatalf("unexpected status for %s: %d", action, status)
+		}
+	}
+
+	if html := get(srv.URL); !strings.Contains(html, "SELECT * FROM tables WHERE a &lt; 1") {
+		t.Errorf("query missing from HTML: %s", html)
+	}
+
+	var info debugInfo
+	if err := json.Unmarshal([]byte(get(srv.URL+"?format=json")), &info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Statements) != 1 || info.Statements[0].Query != query || info.Stats.Misses != 1 {
+		t.Errorf("unexpected JSON: %+v", info)
+	}
+
+	post("pin")
+	if snap := dbsc.Snapshot(); len(snap) != 1 || !snap[0].Pinned || !snap[0].Prepared {
+		t.Errorf("statement not pinned: %+v", snap)
+	}
+
+	if status := postQuery("pin", "SELECT '"+strings.Repeat("x", DefaultMaxQueryLen)+"'"); status != http.StatusBadRequest {
+		t.Errorf("unexpected status for a query too long to be pinned: %d", status)
+	}
+
+	post("invalidate")
+	if snap := dbsc.Snapshot(); len(snap) != 0 {
+		t.Errorf("statement not invalidated: %+v", snap)
+	}
+	if s := dbsc.GetStats(); s.PreparedStmts != 0 || s.Prepared != 1 || s.Unprepared != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// expvar variables can not be removed, so every run (e.g. with -count) needs a new name
+	name := "autoprepare_test"
+	for i := 1; expvar.Get(name) != nil; i++ {
+		name = fmt.Sprintf("autoprepare_test_%d", i)
+	}
+	dbsc.PublishExpvar(name)
+	if v := expvar.Get(name).String(); !strings.Contains(v, `"Stats":{"Prepared":1,`) {
+		t.Errorf("unexpected expvar: %s", v)
+	}
+}
@@ -0,0 +1,102 @@
+package autoprepare
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecayOptions(t *testing.T) {
+	heat := func(opts []SQLStmtCacheOpt, queries func(sim *Simulator)) uint64 {
+		sim, err := NewSimulator(SimOptions{Options: opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sim.Close()
+		queries(sim)
+		st := sim.Statements()
+		if len(st) != 1 {
+			t.Fatalf("unexpected statements: %+v", st)
+		}
+		return st[0].Heat
+	}
+
+	// 11 queries wake up the worker once, that decays hits by 11 queries
+	t0 := time.Unix(0, 0)
+	byQueries := func(sim *Simulator) {
+		for i := 0; i < 11; i++ {
+			sim.Query(t0, "SELECT 1")
+		}
+	}
+	if h := heat([]SQLStmtCacheOpt{WithWorkerThreshold(10)}, byQueries); h != 5 {
+		t.Errorf("unexpected heat with the default half-life: %d", h)
+	}
+	if h := heat([]SQLStmtCacheOpt{WithWorkerThreshold(10), WithQueryDecayHalfLife(40)}, byQueries); h != 9 {
+		t.Errorf("unexpected heat with a half-life of 40 queries: %d", h)
+	}
+
+	// the ticker wakes up the worker twice, after 10s and 20s (with the default
+	// half-life, 10s are not enough for hits to be decayed)
+	byTime := func(sim *Simulator) {
+		for i := 0; i < 100; i++ {
+			sim.Query(t0, "SELECT 1")
+		}
+		sim.Query(t0.Add(20*time.Second), "SELECT 1")
+	}
+	if h := heat(nil, byTime); h != 80 {
+		t.Errorf("unexpected heat with the default half-life: %d", h)
+	}
+	if h := heat([]SQLStmtCacheOpt{WithDecayHalfLife(10 * time.Second)}, byTime); h != 26 {
+		t.Errorf("unexpected heat with a half-life of 10s: %d", h)
+	}
+
+	for _, opt := range []SQLStmtCacheOpt{
+		WithWorkerThreshold(0),
+		WithWorkerThreshold(1<<20 + 1),
+		WithQueryDecayHalfLife(0),
+		WithDecayHalfLife(time.Millisecond),
+		WithDecayHalfLife(25 * time.Hour),
+	} {
+		if _, err := NewSimulator(SimOptions{Options: []SQLStmtCacheOpt{opt}}); err == nil {
+			t.Errorf("invalid option accepted")
+		}
+	}
+}
+
+// TestDecayTruncation checks that hits decay according to the half-life also
+// when they are few, even if the worker runs much more often than the half-life:
+// if decay were applied at every run, truncation would make them drop to 0.
+func TestDecayTruncation(t *testing.T) {
+	sim, err := NewSimulator(SimOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	t0 := time.Unix(0, 0)
+	sim.Query(t0, "SELECT 1")
+	sim.Query(t0, "SELECT 1")
+	// the worker runs every 10s: after 30s, 2 hits decay to 2*2^(-1/2), i.e. 1
+	sim.Query(t0.Add(30*time.Second), "SELECT 1")
+	if st := sim.Statements(); len(st) != 1 || st[0].Heat != 2 {
+		t.Errorf("unexpected statements: %+v", st)
+	}
+}
+
+// TestDecayQueries checks that hits decay according to the number of queries
+// actually executed, and not to the number of worker runs: the worker runs once
+// every WithWorkerThreshold+1 queries, and less often if it is busy.
+func TestDecayQueries(t *testing.T) {
+	sim, err := NewSimulator(SimOptions{Options: []SQLStmtCacheOpt{WithWorkerThreshold(1), WithQueryDecayHalfLife(1024)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	// the worker runs every 2 queries, and decays hits once 1024/4 queries have
+	// been executed: 256 hits decay to 256*2^(-1/4)
+	t0 := time.Unix(0, 0)
+	for i := 0; i < 256; i++ {
+		sim.Query(t0, "SELECT 1")
+	}
+	if st := sim.Statements(); len(st) != 1 || st[0].Heat != 215 {
+		t.Errorf("unexpected statements: %+v", st)
+	}
+}
@@ -0,0 +1,78 @@
+package autoprepare
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// A Rule reports whether a SQL query matches it. Rules are used by WithAllowRules
+// and WithDenyRules to select the queries that are eligible to be prepared. Any
+// function with the right signature can be used as a custom Rule.
+//
+// Rules are evaluated once for each statement, when it starts being tracked,
+// and not every time it is executed. They may be evaluated concurrently, and
+// by the goroutine executing the query, so they should be fast.
+type Rule func(query string) bool
+
+// RegexpRule returns a Rule matching the queries matched by re.
+func RegexpRule(re *regexp.Regexp) Rule {
+	return re.MatchString
+}
+
+// PrefixRule returns a Rule matching the queries that start with any of the
+// prefixes. Leading whitespace in the query is ignored, and the comparison is
+// case-insensitive.
+func PrefixRule(prefixes ...string) Rule {
+	return func(query string) bool {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		for _, p := range prefixes {
+			if len(query) >= len(p) && strings.EqualFold(query[:len(p)], p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WithAllowRules restricts the queries eligible to be prepared to the ones
+// matched by at least one of the rules. If specified multiple times, the rules
+// are added to the previous ones. Queries that are not eligible are always
+// executed without a prepared statement, and are counted in
+// SQLStmtCacheStats.NotPreparable.
+func WithAllowRules(rules ...Rule) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		c.allow = append(c.allow, rules...)
+		return nil
+	}
+}
+
+// WithDenyRules makes the queries matched by any of the rules not eligible to be
+// prepared, even if they are matched by the rules specified with WithAllowRules.
+// If specified multiple times, the rules are added to the previous ones. This
+// is useful e.g. for queries whose result depends on session variables.
+func WithDenyRules(rules ...Rule) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		c.deny = append(c.deny, rules...)
+		return nil
+	}
+}
+
+// eligible returns whether query is eligible to be prepared according to the
+// rules specified with WithAllowRules and WithDenyRules.
+func (c *sqlStmtCache) eligible(query string) bool {
+	for _, r := range c.deny {
+		if r(query) {
+			return false
+		}
+	}
+	if len(c.allow) == 0 {
+		return true
+	}
+	for _, r := range c.allow {
+		if r(query) {
+			return true
+		}
+	}
+	return false
+}
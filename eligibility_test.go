@@ -0,0 +1,109 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEligibilityRules(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	calls := 0
+	dbsc, err := New(db,
+		WithAllowRules(PrefixRule("select", "insert")),
+		WithDenyRules(RegexpRule(regexp.MustCompile(`(?i)\bsqlite_version\(`)), func(q string) bool { calls++; return strings.Contains(q, "secret") }),
+		WithWorkerInterval(10*time.Millisecond),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	queries := []string{" SELECT 1", "SELECT sqlite_version()", "SELECT 'secret'", "VALUES (1)"}
+	for i := 0; i < 3; i++ {
+		for _, q := range queries {
+			if _, err := dbsc.ExecContext(context.Background(), q); err != nil {
+				panic(err)
+			}
+		}
+	}
+	for i := 0; i < 100 && dbsc.GetStats().PreparedStmts != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, s := range dbsc.Snapshot() {
+		if want := s.Query == " SELECT 1"; s.NotPreparable == want || s.Prepared != want {
+			t.Errorf("unexpected statement: %+v", s)
+		}
+	}
+	if s := dbsc.GetStats(); s.NotPreparable != 9 || s.PreparedStmts != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+	// the deny rule is evaluated once per statement not matched by the regexp
+	if calls != 3 {
+		t.Errorf("rule evaluated %d times", calls)
+	}
+
+	if err := dbsc.Pin(context.Background(), "SELECT sqlite_version()"); err != errNotPreparable {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := New(db, WithDenyRules(PrefixRule("SELECT")), WithPinnedStatements("SELECT 1")); err == nil {
+		t.Errorf("denied pinned statement accepted")
+	}
+
+	// rules are not evaluated while the internal locks are held, so they can
+	// even use the cache: here only the first statement is eligible
+	var dbsc2 *SQLStmtCache
+	dbsc2, err = New(db, WithDenyRules(func(string) bool { return len(dbsc2.Snapshot()) > 0 }))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc2.Close()
+	for _, q := range []string{"SELECT 1", "SELECT 2", "SELECT 2"} {
+		if _, err := dbsc2.ExecContext(context.Background(), q); err != nil {
+			panic(err)
+		}
+	}
+	if s := dbsc2.GetStats(); s.NotPreparable != 2 || s.NotHot != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// when the table is full the rules are not evaluated for untracked queries
+	calls = 0
+	dbsc3, err := New(db,
+		WithDenyRules(func(string) bool { calls++; return false }),
+		WithMaxStmt(128),
+		WithWorkerInterval(time.Hour),
+		WithWorkerThreshold(1<<20),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc3.Close()
+	for i := 0; i < 128; i++ {
+		if _, err := dbsc3.ExecContext(context.Background(), fmt.Sprintf("SELECT %d", i)); err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := dbsc3.ExecContext(context.Background(), "SELECT 'untracked'"); err != nil {
+			panic(err)
+		}
+	}
+	if s := dbsc3.GetStats(); s.TableFull != 100 || calls != 128 {
+		t.Errorf("rule evaluated %d times, unexpected stats: %+v", calls, s)
+	}
+}
@@ -0,0 +1,89 @@
+package autoprepare
+
+import (
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"sync/atomic"
+)
+
+// gcSentinel is an object whose finalizer runs once per GC cycle: every time
+// it runs it asks the worker to shrink the cache, and it re-arms itself until
+// Close is called.
+type gcSentinel struct {
+	c *sqlStmtCache
+}
+
+func (c *sqlStmtCache) armGCSentinel() {
+	runtime.SetFinalizer(&gcSentinel{c: c}, (*gcSentinel).fire)
+}
+
+func (s *gcSentinel) fire() {
+	c := s.c
+	select {
+	case <-c.wrkStop:
+		return
+	default:
+	}
+	if c.softMemLimit == 0 || heapBytes() > c.softMemLimit {
+		// finalizers must not block: if a shrink is already pending, there is
+		// no need to request another one
+		select {
+		case c.wrkShrink <- struct{}{}:
+		default:
+		}
+	}
+	c.armGCSentinel()
+}
+
+// heapBytes returns the number of bytes currently occupied by objects in the Go heap.
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// shrink is called by the worker in case of GC or memory pressure. It drops
+// more tracked statements than dropStmts normally does, and closes the prepared
+// statements that are not used anymore. If a soft memory limit has been set
+// (and shrink is called only when the limit is exceeded) it also closes the
+// least frequently used half of the prepared statements. Prepared statements are
+// not closed while the cache is frozen (see Freeze).
+func (c *sqlStmtCache) shrink() {
+	frozen := atomic.LoadUint32(&c.frozen) != 0
+	c.l.RLock()
+	var prepared []*stmt
+	c.stmt.each(func(s *stmt) {
+		if !frozen && s.prepared() && !s.isPinned() {
+			prepared = append(prepared, s)
+		}
+	})
+	c.l.RUnlock()
+
+	sort.Slice(prepared, func(i, j int) bool {
+		return atomic.LoadUint64(&prepared[i].hit) < atomic.LoadUint64(&prepared[j].hit)
+	})
+
+	victims := 0
+	for _, s := range prepared {
+		if atomic.LoadUint64(&s.hit) != 0 {
+			break
+		}
+		victims++
+	}
+	if c.softMemLimit != 0 && victims < (len(prepared)+1)/2 {
+		victims = (len(prepared) + 1) / 2
+	}
+
+	for _, s := range prepared[:victims] {
+		c.unprepare(s, ReasonShrink)
+	}
+
+	trimmed := c.dropStmts(4, ReasonShrink)
+
+	atomic.AddUint64(&c.stats.Shrinks, 1)
+	atomic.AddUint64(&c.stats.Trimmed, uint64(trimmed))
+}
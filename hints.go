@@ -0,0 +1,92 @@
+package autoprepare
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type hintsKey struct{}
+
+// hints are the per-call hints attached to a context by NoPrepare, ForcePrepare
+// and Weight.
+type hints struct {
+	noPrepare bool
+	force     bool
+	weight    uint64
+}
+
+var defaultHints = hints{weight: 1}
+
+func contextHints(ctx context.Context) hints {
+	if h, ok := ctx.Value(hintsKey{}).(*hints); ok {
+		return *h
+	}
+	return defaultHints
+}
+
+func withHints(ctx context.Context, f func(*hints)) context.Context {
+	h := contextHints(ctx)
+	f(&h)
+	return context.WithValue(ctx, hintsKey{}, &h)
+}
+
+// NoPrepare returns a copy of ctx that makes the queries executed with it bypass
+// the cache: they are always executed raw, they are not tracked and they do not
+// affect the choice of the statements to prepare. They are counted in
+// SQLStmtCacheStats.Bypassed. This is useful e.g. for migrations, whose queries
+// are executed only once. NoPrepare takes precedence over ForcePrepare.
+func NoPrepare(ctx context.Context) context.Context {
+	return withHints(ctx, func(h *hints) { h.noPrepare = true })
+}
+
+// ForcePrepare returns a copy of ctx that makes the queries executed with it use
+// a prepared statement, even if they are not executed frequently enough: if
+// needed, the statement is prepared before executing the query, closing the
+// least frequently used prepared statement to make room for it. The query
+// still has to satisfy the other conditions (e.g. WithMaxQueryLen, WithMaxStmt
+// and WithDenyRules), and is executed raw if the statement fails to be prepared:
+// in this case, it is not prepared again until its backoff expires (see
+// SQLStmtCacheStats.Blacklisted).
+// Since the statement is prepared by the background worker, the query may wait
+// for it to finish its current run. ForcePrepare should be used sparingly, e.g.
+// for latency-critical queries, as forcing rarely executed queries evicts
+// frequently executed ones.
+func ForcePrepare(ctx context.Context) context.Context {
+	return withHints(ctx, func(h *hints) { h.force = true })
+}
+
+// Weight returns a copy of ctx that makes the queries executed with it count as
+// n executions when picking the statements to prepare, so that e.g.
+// latency-critical queries are prepared before more frequent ones. The default
+// weight is 1; with a weight of 0 the queries can use a prepared statement, but
+// do not contribute to keeping it prepared. Negative weights are treated as 0.
+func Weight(ctx context.Context, n int) context.Context {
+	if n < 0 {
+		n = 0
+	}
+	return withHints(ctx, func(h *hints) { h.weight = uint64(n) })
+}
+
+// forcePrepare prepares s, if it is not prepared yet (see ForcePrepare). It waits
+// for the worker, unless ctx is done.
+func (c *sqlStmtCache) forcePrepare(ctx context.Context, s *stmt) {
+	c.run(ctx, func() {
+		c.l.RLock()
+		tracked := c.stmt.get(s.q, s.h) == s
+		c.l.RUnlock()
+		if !tracked || s.prepared() || s.isBlacklisted(atomic.LoadInt64(&c.now)) {
+			return
+		}
+		if atomic.LoadUint32(&c.psCount) >= atomic.LoadUint32(&c.maxPS) {
+			victim := c.coldestUnpinned()
+			if victim == nil {
+				return
+			}
+			c.unprepare(victim, ReasonReplaced)
+		}
+		// the query waits for the statement to be prepared, so ctx still applies
+		ctx, cancel := context.WithTimeout(ctx, c.prepareTimeout)
+		defer cancel()
+		c.prepare(ctx, s)
+	})
+}
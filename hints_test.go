@@ -0,0 +1,84 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestHints(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dbsc, err := New(db, WithMaxPreparedStmt(1), WithWorkerInterval(time.Hour), WithDenyRules(PrefixRule("SELECT 4")))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := context.Background()
+	exec := func(ctx context.Context, query string) {
+		if _, err := dbsc.ExecContext(ctx, query); err != nil {
+			panic(err)
+		}
+	}
+	byQuery := func() map[string]StmtStats {
+		m := map[string]StmtStats{}
+		for _, s := range dbsc.Snapshot() {
+			m[s.Query] = s
+		}
+		return m
+	}
+
+	exec(NoPrepare(ForcePrepare(ctx)), "SELECT 1")
+	if s := dbsc.GetStats(); s.Bypassed != 1 || s.Misses != 1 || s.TrackedStmts != 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	exec(Weight(ctx, 10), "SELECT 2")
+	exec(Weight(ctx, -1), "SELECT 3")
+	if m := byQuery(); m["SELECT 2"].Heat != 10 || m["SELECT 3"].Heat != 0 {
+		t.Errorf("unexpected statements: %+v", m)
+	}
+
+	// the first forced query is prepared before being executed
+	exec(ForcePrepare(ctx), "SELECT 3")
+	if m := byQuery(); !m["SELECT 3"].Prepared || m["SELECT 3"].Hits != 1 {
+		t.Errorf("unexpected statements: %+v", m)
+	}
+	// the second one replaces it, as WithMaxPreparedStmt(1) is used
+	exec(ForcePrepare(ctx), "SELECT 2")
+	if m := byQuery(); !m["SELECT 2"].Prepared || m["SELECT 3"].Prepared {
+		t.Errorf("unexpected statements: %+v", m)
+	}
+	if s := dbsc.GetStats(); s.Prepared != 2 || s.Unprepared != 1 || s.PreparedStmts != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// statements that are not eligible are not prepared
+	exec(ForcePrepare(ctx), "SELECT 4")
+	if s := dbsc.GetStats(); s.Prepared != 2 || s.NotPreparable != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// statements that failed to be prepared are not prepared again by every query
+	for i := 0; i < 3; i++ {
+		if _, err := dbsc.ExecContext(ForcePrepare(ctx), "SELECT * FROM nonexistent"); err == nil {
+			t.Errorf("query succeeded")
+		}
+	}
+	if m := byQuery(); m["SELECT * FROM nonexistent"].PrepareErrors != 1 {
+		t.Errorf("unexpected statements: %+v", m)
+	}
+	if s := dbsc.GetStats(); s.Prepared != 2 || s.Blacklisted != 3 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
@@ -0,0 +1,120 @@
+package autoprepare
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Histograms use HDR-style log-linear buckets: durations are measured in units
+// of histMin, and every power-of-two range of units is split into histSub
+// linear sub-buckets, so that the bounds of the buckets are at most 1/histSub
+// (12.5%) larger than the durations they count. The first histSub buckets count
+// the durations up to 1, 2, ..., histSub units. The last bucket counts all
+// durations greater than the bound of the second to last bucket (histMin<<histOctaves,
+// about 16.8s).
+const (
+	histMin     = time.Microsecond
+	histSubBits = 3
+	histSub     = 1 << histSubBits
+	histOctaves = 24
+	histBuckets = histSub + (histOctaves-histSubBits)*histSub + 1
+)
+
+// histBounds contains the inclusive upper bounds of all buckets but the last one.
+var histBounds = func() (b [histBuckets - 1]time.Duration) {
+	for i := range b {
+		if i < histSub {
+			b[i] = time.Duration(i+1) * histMin
+			continue
+		}
+		octave, sub := i/histSub+histSubBits-1, i%histSub+1
+		b[i] = time.Duration(1<<octave+sub<<(octave-histSubBits)) * histMin
+	}
+	return b
+}()
+
+// histogram is a lock-free histogram of durations, with log-linear buckets.
+type histogram struct {
+	counts [histBuckets]uint64
+	sum    uint64 // nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.AddUint64(&h.counts[histBucket(d)], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+func histBucket(d time.Duration) int {
+	if d <= histMin {
+		return 0
+	}
+	u := uint64((d - 1) / histMin) // units, rounded up, minus one
+	if u < histSub {
+		return int(u)
+	}
+	octave := bits.Len64(u) - 1 // 1<<octave < units <= 2<<octave
+	if octave >= histOctaves {
+		return histBuckets - 1
+	}
+	sub := (u - 1<<octave) >> (octave - histSubBits)
+	return (octave-histSubBits+1)*histSub + int(sub)
+}
+
+// HistogramSnapshot contains a snapshot of a latency histogram.
+type HistogramSnapshot struct {
+	// Bounds contains the inclusive upper bounds of all buckets but the last one,
+	// whose upper bound is +Inf.
+	Bounds []time.Duration
+	// Counts contains the number of observations in each bucket (they are not
+	// cumulative). len(Counts) is len(Bounds)+1.
+	Counts []uint64
+	Count  uint64        // total number of observations
+	Sum    time.Duration // sum of all observations
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: append([]time.Duration(nil), histBounds[:]...),
+		Counts: make([]uint64, histBuckets),
+		Sum:    time.Duration(atomic.LoadUint64(&h.sum)),
+	}
+	for i := range s.Counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+		s.Count += s.Counts[i]
+	}
+	return s
+}
+
+// Mean returns the average of the observations, or 0 if there are none.
+func (s HistogramSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// Quantile returns an upper bound of the q-quantile (0 <= q <= 1) of the
+// observations, i.e. the upper bound of the bucket containing it. If the
+// quantile falls in the last bucket, the bound of the second to last bucket is
+// returned. It returns 0 if there are no observations.
+func (s HistogramSnapshot) Quantile(q float64) time.Duration {
+	if s.Count == 0 || len(s.Bounds) == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(s.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var cum uint64
+	for i, n := range s.Counts[:len(s.Bounds)] {
+		cum += n
+		if cum >= rank {
+			return s.Bounds[i]
+		}
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
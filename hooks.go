@@ -0,0 +1,72 @@
+package autoprepare
+
+import (
+	"time"
+)
+
+// Reasons reported in Event.Reason, and used as labels by CollectMetrics.
+const (
+	// reasons for queries executed raw
+	ReasonDisabled      = "disabled"       // the cache is disabled
+	ReasonTooLong       = "too_long"       // the query is longer than allowed by WithMaxQueryLen
+	ReasonTableFull     = "table_full"     // the query could not be tracked, as too many statements are tracked
+	ReasonNotHot        = "not_hot"        // the query is not (yet) executed frequently enough to be prepared
+	ReasonBlacklisted   = "blacklisted"    // the query failed to be prepared recently
+	ReasonNotPreparable = "not_preparable" // the query is not eligible to be prepared
+	ReasonCanceled      = "canceled"       // the context of the query was already done
+	ReasonBypassed      = "bypassed"       // the context of the query was returned by NoPrepare
+	ReasonWouldHit      = "would_hit"      // the query would have used a prepared statement (see WithShadowMode)
+	ReasonPaused        = "paused"         // the query is not tracked, as tracking is paused (see Pause)
+
+	// reasons for prepared statements being closed, or statements not being tracked anymore
+	ReasonReplaced     = "replaced"     // the prepared statement was closed to make room for a more frequent one
+	ReasonCold         = "cold"         // the statement was not executed frequently enough to be tracked
+	ReasonIdle         = "idle"         // the statement was not executed for longer than WithIdleTTL
+	ReasonShrink       = "shrink"       // the cache was shrunk because of GC or memory pressure
+	ReasonInvalidated  = "invalidated"  // Invalidate was called
+	ReasonReconfigured = "reconfigured" // the limits were lowered by Reconfigure
+
+	// reasons for the worker to run
+	ReasonQueries = "queries" // enough queries have been executed since the last run
+	ReasonTicker  = "ticker"  // enough time has elapsed since the last run
+)
+
+// Event describes something that happened in a SQLStmtCache. It is passed to the Hooks.
+type Event struct {
+	Query    string        // SQL query the event refers to; empty for OnWorkerCycle
+	Duration time.Duration // duration of the operation, if any
+	Reason   string        // reason of the event (one of the Reason constants), if any
+	Err      error         // error, for OnPrepareError
+	Shadow   bool          // for OnPrepare and OnEvict, the statement was not actually prepared or closed (see WithShadowMode)
+}
+
+// Hooks contains functions that are called when the corresponding events happen.
+// All functions are optional. They are called synchronously, so they should
+// return quickly. Most of them are called by the background worker, so they must
+// not do anything that waits for it, or they would deadlock: this includes calling
+// Close, Pin, Unpin, Invalidate or Reconfigure, and executing queries with a
+// context returned by ForcePrepare.
+type Hooks struct {
+	OnPrepare      func(Event) // a statement has been prepared
+	OnPrepareError func(Event) // a statement failed to be prepared
+	OnEvict        func(Event) // a prepared statement has been closed
+	OnDrop         func(Event) // a statement stopped being tracked
+	OnSkip         func(Event) // a query has been executed raw without being tracked (called by the goroutine executing the query)
+	OnWorkerCycle  func(Event) // the background worker has completed a run
+}
+
+// WithHooks specifies functions to be called when statements are prepared,
+// evicted or dropped, when queries are skipped, and when the background worker
+// runs. It allows to log or trace what autoprepare is doing.
+func WithHooks(h Hooks) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		c.hooks = h
+		return nil
+	}
+}
+
+func callHook(f func(Event), e Event) {
+	if f != nil {
+		f(e)
+	}
+}
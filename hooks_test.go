@@ -0,0 +1,85 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	var l sync.Mutex
+	events := map[string][]Event{}
+	record := func(kind string) func(Event) {
+		return func(e Event) {
+			l.Lock()
+			events[kind] = append(events[kind], e)
+			l.Unlock()
+		}
+	}
+	get := func(kind string) []Event {
+		l.Lock()
+		defer l.Unlock()
+		return append([]Event(nil), events[kind]...)
+	}
+
+	dbsc, err := New(db, WithWorkerInterval(10*time.Millisecond), WithMaxQueryLen(32), WithHooks(Hooks{
+		OnPrepare:      record("prepare"),
+		OnPrepareError: record("prepareError"),
+		OnEvict:        record("evict"),
+		OnDrop:         record("drop"),
+		OnSkip:         record("skip"),
+		OnWorkerCycle:  record("cycle"),
+	}))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := context.Background()
+
+	const query = "SELECT 1"
+	if _, err := dbsc.ExecContext(ctx, query); err != nil {
+		panic(err)
+	}
+	long := "SELECT '" + strings.Repeat("x", 32) + "'"
+	if _, err := dbsc.ExecContext(ctx, long); err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 100 && len(get("prepare")) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dbsc.Invalidate(query)
+
+	if e := get("prepare"); len(e) != 1 || e[0].Query != query || e[0].Duration <= 0 {
+		t.Errorf("unexpected OnPrepare events: %+v", e)
+	}
+	if e := get("evict"); len(e) != 1 || e[0].Query != query || e[0].Reason != ReasonInvalidated {
+		t.Errorf("unexpected OnEvict events: %+v", e)
+	}
+	if e := get("drop"); len(e) != 1 || e[0].Query != query || e[0].Reason != ReasonInvalidated {
+		t.Errorf("unexpected OnDrop events: %+v", e)
+	}
+	if e := get("skip"); len(e) != 1 || e[0].Query != long || e[0].Reason != ReasonTooLong {
+		t.Errorf("unexpected OnSkip events: %+v", e)
+	}
+	if e := get("prepareError"); len(e) != 0 {
+		t.Errorf("unexpected OnPrepareError events: %+v", e)
+	}
+	if e := get("cycle"); len(e) == 0 || e[0].Reason != ReasonTicker {
+		t.Errorf("unexpected OnWorkerCycle events: %+v", e)
+	}
+}
@@ -0,0 +1,156 @@
+package autoprepare
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// hotSetEntry is a statement in the hot set written by ExportHotSet.
+type hotSetEntry struct {
+	Query string `json:"query"`
+	Heat  uint64 `json:"heat"`
+}
+
+// ExportHotSet writes to w the set of statements that are currently prepared,
+// so that they can be prepared as soon as another SQLStmtCache is created (see
+// WithWarmStart), e.g. after the process is restarted. The hot set is
+// line-delimited JSON: each line contains a JSON object with the SQL query
+// ("query") and its heat ("heat", see StmtStats), from the hottest to the
+// coldest statement.
+func (c *SQLStmtCache) ExportHotSet(w io.Writer) error {
+	var hot []hotSetEntry
+	c.l.RLock()
+	c.stmt.each(func(s *stmt) {
+		if s.prepared() {
+			hot = append(hot, hotSetEntry{Query: s.q, Heat: atomic.LoadUint64(&s.hit)})
+		}
+	})
+	c.l.RUnlock()
+
+	sort.Slice(hot, func(i, j int) bool {
+		if hot[i].Heat != hot[j].Heat {
+			return hot[i].Heat > hot[j].Heat
+		}
+		return hot[i].Query < hot[j].Query
+	})
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, e := range hot {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// WithWarmStart reads from r a hot set written by ExportHotSet, and makes the
+// background worker prepare the statements it contains (up to the limit set by
+// WithMaxPreparedStmt) as soon as the SQLStmtCache is created, instead of
+// waiting for them to be executed frequently enough. The statements start with
+// the heat they had when they were exported: if they are not executed before
+// their heat decays to 0 they are closed and stop being tracked, even if there
+// is still room for them. Once executed, they are treated like any other
+// statement. New fails if r can not be read or does not contain a valid hot set.
+func WithWarmStart(r io.Reader) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		dec := json.NewDecoder(r)
+		for {
+			var e hotSetEntry
+			if err := dec.Decode(&e); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("WithWarmStart: invalid hot set: %w", err)
+			}
+			c.warm = append(c.warm, e)
+		}
+	}
+}
+
+// warmStart tracks and prepares the statements of the hot set read by
+// WithWarmStart. It must be called only by the worker.
+func (c *sqlStmtCache) warmStart() {
+	warm := c.warm
+	c.warm = nil
+	for _, e := range warm {
+		select {
+		case <-c.wrkStop:
+			return
+		default:
+		}
+		if atomic.LoadUint32(&c.psCount) >= atomic.LoadUint32(&c.maxPS) {
+			return
+		}
+		if int64(len(e.Query)) > atomic.LoadInt64(&c.maxSqlLen) {
+			continue
+		}
+
+		h := c.stmt.hash(e.Query)
+		c.l.RLock()
+		s := c.stmt.get(e.Query, h)
+		c.l.RUnlock()
+		if s == nil {
+			eligible := c.eligible(e.Query)
+			c.l.Lock()
+			if s = c.stmt.get(e.Query, h); s == nil && c.hasRoom(e.Query) {
+				s = newStmt(c.intern(e.Query), h, e.Heat, atomic.LoadInt64(&c.now))
+				s.notPreparable = !eligible
+				c.track(s)
+			}
+			c.l.Unlock()
+		}
+		if s == nil || s.notPreparable || s.prepared() {
+			continue
+		}
+
+		// mark the statement before preparing it, so that it is not mistaken
+		// for a stale one if it is executed in the meantime
+		atomic.StoreUint32(&s.warm, 1)
+		c.warmStmts++
+		ctx, cancel := context.WithTimeout(context.Background(), c.prepareTimeout)
+		c.prepare(ctx, s)
+		cancel()
+	}
+}
+
+// dropWarmStmts closes, and stops tracking, the statements prepared by warmStart
+// whose heat decayed to 0 without them being executed. This is needed as the
+// worker closes a prepared statement only to make room for a hotter one, so
+// stale statements would otherwise stay prepared as long as there is room for
+// them. It must be called only by the worker.
+func (c *sqlStmtCache) dropWarmStmts() {
+	if c.warmStmts == 0 || atomic.LoadUint32(&c.frozen) != 0 {
+		return
+	}
+
+	var stale []*stmt
+	warm := 0
+	c.l.Lock()
+	c.stmt.each(func(s *stmt) {
+		if !s.isWarm() {
+			return
+		}
+		if atomic.LoadUint64(&s.hit) != 0 || s.isPinned() {
+			warm++
+			return
+		}
+		stale = append(stale, s)
+	})
+	for _, s := range stale {
+		c.untrack(s)
+	}
+	c.l.Unlock()
+	c.warmStmts = warm
+
+	for _, s := range stale {
+		if s.prepared() {
+			c.unprepare(s, ReasonCold)
+		}
+		callHook(c.hooks.OnDrop, Event{Query: s.q, Reason: ReasonCold})
+	}
+}
@@ -0,0 +1,127 @@
+package autoprepare
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarmStart(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dbsc, err := New(db, WithWorkerInterval(10*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+	const query = "SELECT 1"
+	if _, err := dbsc.ExecContext(context.Background(), query); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 100 && !dbsc.Snapshot()[0].Prepared; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	if err := dbsc.ExportHotSet(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dbsc.Close()
+	if !strings.HasPrefix(buf.String(), `{"query":"SELECT 1","heat":`) || strings.Count(buf.String(), "\n") != 1 {
+		t.Fatalf("unexpected hot set: %q", buf.String())
+	}
+
+	// add a statement that can not be prepared, and one that is too long
+	buf.WriteString(`{"query":"SELECT * FROM nonexistent","heat":1}` + "\n")
+	buf.WriteString(`{"query":"SELECT '` + strings.Repeat("x", 64) + `'","heat":1}` + "\n")
+
+	dbsc, err = New(db, WithWarmStart(&buf), WithMaxQueryLen(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbsc.Close()
+	byQuery := map[string]StmtStats{}
+	for i := 0; i < 100; i++ {
+		byQuery = map[string]StmtStats{}
+		for _, s := range dbsc.Snapshot() {
+			byQuery[s.Query] = s
+		}
+		if byQuery[query].Prepared && byQuery["SELECT * FROM nonexistent"].PrepareErrors == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := byQuery[query]; len(byQuery) != 2 || !s.Prepared || s.Heat == 0 {
+		t.Errorf("unexpected statements: %+v", byQuery)
+	}
+	if s := byQuery["SELECT * FROM nonexistent"]; s.Prepared || s.PrepareErrors != 1 {
+		t.Errorf("unexpected statements: %+v", byQuery)
+	}
+	if s := dbsc.GetStats(); s.Prepared != 1 || s.PreparedStmts != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	if _, err := New(db, WithWarmStart(strings.NewReader("SELECT 1\n"))); err == nil {
+		t.Errorf("invalid hot set accepted")
+	}
+}
+
+func TestWarmStartStale(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dropped := make(chan Event, 2)
+	// the heat of the second statement is high enough for it not to decay to 0
+	// before it is executed
+	hot := `{"query":"SELECT 2","heat":1000}` + "\n" + `{"query":"SELECT 1","heat":1}` + "\n"
+	dbsc, err := New(db,
+		WithWarmStart(strings.NewReader(hot)),
+		WithWorkerInterval(10*time.Millisecond),
+		WithDecayHalfLife(time.Second),
+		WithHooks(Hooks{OnDrop: func(e Event) { dropped <- e }}),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+	for i := 0; i < 100 && dbsc.GetStats().PreparedStmts != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := dbsc.ExecContext(context.Background(), "SELECT 2"); err != nil {
+		panic(err)
+	}
+
+	// the statement that is not executed is closed once its heat decays to 0,
+	// even if there is room for it; the other one is left alone
+	select {
+	case e := <-dropped:
+		if e.Query != "SELECT 1" || e.Reason != ReasonCold {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stale statement not dropped")
+	}
+	for i := 0; i < 100 && dbsc.GetStats().PreparedStmts != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := dbsc.Snapshot(); len(s) != 1 || s[0].Query != "SELECT 2" || !s[0].Prepared {
+		t.Errorf("unexpected statements: %+v", s)
+	}
+}
@@ -0,0 +1,122 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Op is the kind of operation performed by a Call.
+type Op int
+
+const (
+	OpQuery    Op = iota // QueryContext and QueryContextTx
+	OpQueryRow           // QueryRowContext and QueryRowContextTx
+	OpExec               // ExecContext and ExecContextTx
+)
+
+// String returns the name of the SQLStmtCache method (without the Tx suffix)
+// corresponding to op.
+func (op Op) String() string {
+	switch op {
+	case OpQuery:
+		return "QueryContext"
+	case OpQueryRow:
+		return "QueryRowContext"
+	case OpExec:
+		return "ExecContext"
+	}
+	return "unknown"
+}
+
+// Call describes a query executed via a SQLStmtCache. It is passed to the Interceptors.
+type Call struct {
+	Op       Op
+	Query    string        // SQL query
+	Args     []interface{} // arguments of the SQL query
+	Tx       *sql.Tx       // transaction the query is executed in; nil if none
+	Prepared bool          // whether the query is executed using an automatically-prepared statement
+
+	// Results of the query, depending on Op. They are set when the query is executed.
+	Rows   *sql.Rows  // OpQuery
+	Row    *sql.Row   // OpQueryRow
+	Result sql.Result // OpExec
+
+	ps  *sql.Stmt     // prepared statement to be used, if any
+	dur time.Duration // time taken by the execution of the query
+}
+
+// Invoker executes the query described by a Call.
+type Invoker func(ctx context.Context, call *Call) error
+
+// Interceptor wraps the execution of a query. It must call next, possibly with a
+// different context, to execute the query, and it should return the error returned
+// by next. Once next returns, the results of the query are available in call.
+// For OpQueryRow the error returned by next is the one returned by call.Row.Err(),
+// and next must always be called as the *sql.Row set by next is returned to the caller.
+// Interceptors must not modify call.Query or call.Tx.
+type Interceptor func(ctx context.Context, call *Call, next Invoker) error
+
+// WithInterceptors adds interceptors that wrap the execution of every query
+// executed via the SQLStmtCache, both when using prepared statements and not.
+// The first interceptor is the outermost one.
+func WithInterceptors(interceptors ...Interceptor) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		c.interceptors = append(c.interceptors, interceptors...)
+		return nil
+	}
+}
+
+func (c *sqlStmtCache) buildInvoker() {
+	c.invoker = c.execute
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := c.interceptors[i], c.invoker
+		c.invoker = func(ctx context.Context, call *Call) error {
+			return interceptor(ctx, call, next)
+		}
+	}
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// execute is the innermost Invoker: it actually executes the query.
+func (c *sqlStmtCache) execute(ctx context.Context, call *Call) (err error) {
+	start := time.Now()
+	defer func() { call.dur = time.Since(start) }()
+
+	if ps := call.ps; ps != nil {
+		if call.Tx != nil {
+			ps = call.Tx.StmtContext(ctx, ps)
+		}
+		switch call.Op {
+		case OpQuery:
+			call.Rows, err = ps.QueryContext(ctx, call.Args...)
+		case OpQueryRow:
+			call.Row = ps.QueryRowContext(ctx, call.Args...)
+			err = call.Row.Err()
+		case OpExec:
+			call.Result, err = ps.ExecContext(ctx, call.Args...)
+		}
+		return err
+	}
+
+	var q queryer = c.c
+	if call.Tx != nil {
+		q = call.Tx
+	}
+	switch call.Op {
+	case OpQuery:
+		call.Rows, err = q.QueryContext(ctx, call.Query, call.Args...)
+	case OpQueryRow:
+		call.Row = q.QueryRowContext(ctx, call.Query, call.Args...)
+		err = call.Row.Err()
+	case OpExec:
+		call.Result, err = q.ExecContext(ctx, call.Query, call.Args...)
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInterceptors(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS tables (a INT, b TEXT)"); err != nil {
+		panic(err)
+	}
+
+	var l sync.Mutex
+	var trace []string
+	var calls []Call
+	interceptor := func(name string) Interceptor {
+		return func(ctx context.Context, call *Call, next Invoker) error {
+			l.Lock()
+			trace = append(trace, name+">")
+			l.Unlock()
+			err := next(ctx, call)
+			l.Lock()
+			trace = append(trace, "<"+name)
+			if name == "outer" {
+				calls = append(calls, *call)
+			}
+			l.Unlock()
+			return err
+		}
+	}
+	reset := func() ([]string, []Call) {
+		l.Lock()
+		defer l.Unlock()
+		tr, c := trace, calls
+		trace, calls = nil, nil
+		return tr, c
+	}
+
+	dbsc, err := New(db, WithWorkerInterval(10*time.Millisecond), WithInterceptors(interceptor("outer")), WithInterceptors(interceptor("inner")))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := context.Background()
+	const query = "SELECT COUNT(*) FROM tables WHERE a > ?"
+
+	var n int
+	if err := dbsc.QueryRowContext(ctx, query, 1).Scan(&n); err != nil {
+		panic(err)
+	}
+	tr, c := reset()
+	if exp := []string{"outer>", "inner>", "<inner", "<outer"}; !reflect.DeepEqual(tr, exp) {
+		t.Errorf("unexpected order: %v", tr)
+	}
+	if len(c) != 1 || c[0].Op != OpQueryRow || c[0].Query != query || !reflect.DeepEqual(c[0].Args, []interface{}{1}) || c[0].Row == nil || c[0].Prepared {
+		t.Errorf("unexpected call: %+v", c)
+	}
+
+	for i := 0; i < 100 && len(dbsc.Snapshot()) > 0 && !dbsc.Snapshot()[0].Prepared; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	if _, err := dbsc.ExecContextTx(ctx, tx, "INSERT INTO tables (a, b) VALUES (?, ?)", 1, "x"); err != nil {
+		panic(err)
+	}
+	rows, err := dbsc.QueryContextTx(ctx, tx, query, 1)
+	if err != nil {
+		panic(err)
+	}
+	rows.Close()
+
+	_, c = reset()
+	if len(c) != 2 {
+		t.Fatalf("unexpected calls: %+v", c)
+	}
+	if c[0].Op != OpExec || c[0].Tx != tx || c[0].Result == nil || c[0].Prepared {
+		t.Errorf("unexpected exec call: %+v", c[0])
+	}
+	if c[1].Op != OpQuery || c[1].Tx != tx || c[1].Rows == nil || !c[1].Prepared {
+		t.Errorf("unexpected query call: %+v", c[1])
+	}
+}
+
+func TestInterceptorError(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	errDenied := fmt.Errorf("denied")
+	dbsc, err := New(db, WithInterceptors(func(ctx context.Context, call *Call, next Invoker) error {
+		if call.Op == OpExec {
+			return errDenied
+		}
+		return next(ctx, call)
+	}))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	if _, err := dbsc.ExecContext(context.Background(), "SELECT 1"); err != errDenied {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if st := dbsc.GetStats(); st.Misses != 1 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestInterceptorPanic(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dbsc, err := New(db, WithInterceptors(func(ctx context.Context, call *Call, next Invoker) error {
+		if call.Prepared {
+			panic("interceptor")
+		}
+		return next(ctx, call)
+	}))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	const query = "SELECT 1"
+	if err := dbsc.Pin(context.Background(), query); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("interceptor did not panic")
+			}
+		}()
+		dbsc.ExecContext(context.Background(), query)
+	}()
+
+	// the prepared statement must have been released by the panicking query
+	done := make(chan struct{})
+	go func() {
+		dbsc.Invalidate(query)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Invalidate blocked")
+	}
+}
+
+func TestNoInterceptorsAllocs(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dbsc, err := New(db)
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	const query = "SELECT 1"
+	if err := dbsc.Pin(context.Background(), query); err != nil {
+		t.Fatal(err)
+	}
+	ps, err := db.Prepare(query)
+	if err != nil {
+		panic(err)
+	}
+	defer ps.Close()
+
+	// without interceptors, using the cache must not allocate more than using
+	// a prepared statement directly
+	ctx := context.Background()
+	direct := testing.AllocsPerRun(100, func() {
+		ps.ExecContext(ctx)
+	})
+	cached := testing.AllocsPerRun(100, func() {
+		dbsc.ExecContext(ctx, query)
+	})
+	if cached > direct {
+		t.Errorf("unexpected allocations: %v, %v without the cache", cached, direct)
+	}
+}
@@ -0,0 +1,190 @@
+package autoprepare
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxLabelSets is the default maximum number of label sets for which
+// statistics are kept (see WithMaxLabelSets).
+const DefaultMaxLabelSets = 100
+
+type labelsKey struct{}
+
+// labelSet is the set of labels attached to a context by WithLabel.
+type labelSet struct {
+	labels []MetricLabel // sorted by name
+	key    string        // canonical representation of labels
+}
+
+// WithLabel returns a copy of ctx carrying the label name=value, in addition to
+// the labels already carried by ctx (a label with the same name is replaced).
+// The statistics of the queries executed via a SQLStmtCache with a context
+// carrying labels are aggregated per label set, and are returned by LabelStats.
+// Labels should identify the callers (e.g. endpoint or tenant), and they should
+// have few distinct values, as the number of label sets is limited by
+// WithMaxLabelSets.
+func WithLabel(ctx context.Context, name, value string) context.Context {
+	var labels []MetricLabel
+	if ls, _ := ctx.Value(labelsKey{}).(*labelSet); ls != nil {
+		labels = make([]MetricLabel, 0, len(ls.labels)+1)
+		labels = append(labels, ls.labels...)
+	}
+	i := sort.Search(len(labels), func(i int) bool { return labels[i].Name >= name })
+	if i < len(labels) && labels[i].Name == name {
+		labels[i].Value = value
+	} else {
+		labels = append(labels, MetricLabel{})
+		copy(labels[i+1:], labels[i:])
+		labels[i] = MetricLabel{name, value}
+	}
+
+	var sb strings.Builder
+	for _, l := range labels {
+		for _, s := range [...]string{l.Name, l.Value} {
+			sb.WriteString(strconv.Itoa(len(s)))
+			sb.WriteByte(':')
+			sb.WriteString(s)
+		}
+	}
+	return context.WithValue(ctx, labelsKey{}, &labelSet{labels: labels, key: sb.String()})
+}
+
+// ContextLabels returns the labels attached to ctx by WithLabel, sorted by name.
+// It can be used e.g. by Interceptors.
+func ContextLabels(ctx context.Context) []MetricLabel {
+	ls, _ := ctx.Value(labelsKey{}).(*labelSet)
+	if ls == nil {
+		return nil
+	}
+	return append([]MetricLabel(nil), ls.labels...)
+}
+
+// WithMaxLabelSets specifies the maximum number of label sets (see WithLabel) for
+// which statistics are kept. The statistics of the queries with additional label
+// sets are aggregated together (see LabelStats.Overflow). Setting this value to 0
+// disables the statistics per label set. It defaults to DefaultMaxLabelSets.
+func WithMaxLabelSets(max int) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if max > 1<<12 {
+			return errors.New("WithMaxLabelSets should be no more than 4096")
+		}
+		if max < 0 {
+			return errors.New("WithMaxLabelSets should be at least 0")
+		}
+		c.labels.max = max
+		return nil
+	}
+}
+
+// LabelStats contains the statistics of the queries executed with a context
+// carrying a specific label set.
+type LabelStats struct {
+	Labels   []MetricLabel     // labels, sorted by name; nil if Overflow
+	Overflow bool              // whether the statistics refer to all label sets exceeding WithMaxLabelSets
+	Hits     uint64            // number of queries that used automatically-prepared statements
+	Misses   uint64            // number of queries executed raw
+	Hit      HistogramSnapshot // latency of the queries that used automatically-prepared statements
+	Miss     HistogramSnapshot // latency of the queries executed raw
+}
+
+// LabelStats returns the statistics of the queries executed with a context
+// carrying labels (see WithLabel), aggregated per label set, sorted from the
+// label set with the most queries to the one with the least. Queries executed
+// with a context carrying no labels are not included.
+func (c *SQLStmtCache) LabelStats() []LabelStats {
+	return c.labels.stats()
+}
+
+// labelTable contains the statistics per label set.
+type labelTable struct {
+	overflow labelCounters // first, to be 64-bit aligned on 32-bit platforms
+	l        sync.RWMutex
+	m        map[string]*labelCounters // protected by l
+	max      int                       // constant after New() returns
+}
+
+type labelCounters struct {
+	hit    histogram // histograms first, to be 64-bit aligned on 32-bit platforms
+	miss   histogram
+	labels []MetricLabel
+}
+
+// count records the execution of a query, that took d, with a context carrying
+// labels (if any).
+func (t *labelTable) count(ctx context.Context, hit bool, d time.Duration) {
+	if t.max == 0 {
+		return
+	}
+	ls, _ := ctx.Value(labelsKey{}).(*labelSet)
+	if ls == nil {
+		return
+	}
+	lc := t.get(ls)
+	if hit {
+		lc.hit.observe(d)
+	} else {
+		lc.miss.observe(d)
+	}
+}
+
+func (t *labelTable) get(ls *labelSet) *labelCounters {
+	t.l.RLock()
+	lc := t.m[ls.key]
+	t.l.RUnlock()
+	if lc != nil {
+		return lc
+	}
+
+	t.l.Lock()
+	defer t.l.Unlock()
+	if lc = t.m[ls.key]; lc != nil {
+		return lc
+	}
+	if len(t.m) >= t.max {
+		return &t.overflow
+	}
+	if t.m == nil {
+		t.m = make(map[string]*labelCounters)
+	}
+	lc = &labelCounters{labels: ls.labels}
+	t.m[ls.key] = lc
+	return lc
+}
+
+func (t *labelTable) stats() []LabelStats {
+	t.l.RLock()
+	stats := make([]LabelStats, 0, len(t.m)+1)
+	for _, lc := range t.m {
+		stats = append(stats, lc.stats())
+	}
+	t.l.RUnlock()
+	if st := t.overflow.stats(); st.Hits+st.Misses > 0 {
+		st.Labels, st.Overflow = nil, true
+		stats = append(stats, st)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		ni, nj := stats[i].Hits+stats[i].Misses, stats[j].Hits+stats[j].Misses
+		if ni != nj {
+			return ni > nj
+		}
+		return !stats[i].Overflow && stats[j].Overflow
+	})
+	return stats
+}
+
+func (lc *labelCounters) stats() LabelStats {
+	st := LabelStats{
+		Labels: append([]MetricLabel(nil), lc.labels...),
+		Hit:    lc.hit.snapshot(),
+		Miss:   lc.miss.snapshot(),
+	}
+	st.Hits, st.Misses = st.Hit.Count, st.Miss.Count
+	return st
+}
@@ -0,0 +1,85 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestWithLabel(t *testing.T) {
+	ctx := context.Background()
+	if l := ContextLabels(ctx); l != nil {
+		t.Errorf("unexpected labels: %v", l)
+	}
+
+	ctx1 := WithLabel(ctx, "tenant", "a")
+	ctx2 := WithLabel(WithLabel(ctx1, "endpoint", "/orders"), "tenant", "b")
+	if l, exp := ContextLabels(ctx1), []MetricLabel{{"tenant", "a"}}; !reflect.DeepEqual(l, exp) {
+		t.Errorf("unexpected labels: got %v, want %v", l, exp)
+	}
+	if l, exp := ContextLabels(ctx2), []MetricLabel{{"endpoint", "/orders"}, {"tenant", "b"}}; !reflect.DeepEqual(l, exp) {
+		t.Errorf("unexpected labels: got %v, want %v", l, exp)
+	}
+
+	// the same label set must have the same key regardless of the order of the labels
+	ctx3 := WithLabel(WithLabel(ctx, "tenant", "b"), "endpoint", "/orders")
+	if k2, k3 := ctx2.Value(labelsKey{}).(*labelSet).key, ctx3.Value(labelsKey{}).(*labelSet).key; k2 != k3 {
+		t.Errorf("different keys for the same label set: %q, %q", k2, k3)
+	}
+	// and different label sets must have different keys
+	ctx4 := WithLabel(ctx, "tenant", "b1:/orders")
+	if k2, k4 := ctx2.Value(labelsKey{}).(*labelSet).key, ctx4.Value(labelsKey{}).(*labelSet).key; k2 == k4 {
+		t.Errorf("same key for different label sets: %q", k2)
+	}
+}
+
+func TestLabelStats(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dbsc, err := New(db, WithMaxLabelSets(2))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := context.Background()
+	exec := func(ctx context.Context, n int) {
+		for i := 0; i < n; i++ {
+			if _, err := dbsc.ExecContext(ctx, "SELECT 1"); err != nil {
+				panic(err)
+			}
+		}
+	}
+	exec(ctx, 1)
+	exec(WithLabel(ctx, "tenant", "a"), 3)
+	exec(WithLabel(ctx, "tenant", "b"), 2)
+	exec(WithLabel(ctx, "tenant", "c"), 1)
+	exec(WithLabel(ctx, "tenant", "d"), 1)
+
+	st := dbsc.LabelStats()
+	if len(st) != 3 {
+		t.Fatalf("unexpected label stats: %+v", st)
+	}
+	for i, exp := range []struct {
+		labels   []MetricLabel
+		overflow bool
+		misses   uint64
+	}{
+		{[]MetricLabel{{"tenant", "a"}}, false, 3},
+		{[]MetricLabel{{"tenant", "b"}}, false, 2},
+		{nil, true, 2},
+	} {
+		if s := st[i]; !reflect.DeepEqual(s.Labels, exp.labels) || s.Overflow != exp.overflow || s.Misses != exp.misses || s.Hits != 0 || s.Miss.Count != exp.misses {
+			t.Errorf("unexpected label stats %d: %+v", i, s)
+		}
+	}
+}
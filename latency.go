@@ -0,0 +1,87 @@
+package autoprepare
+
+import (
+	"sort"
+	"unsafe"
+)
+
+// stmtLatency contains the latency histograms of a single statement.
+type stmtLatency struct {
+	hit  histogram // executions that used the prepared statement
+	miss histogram // executions that did not use the prepared statement
+}
+
+// stmtLatencySize is the additional memory used to track a statement when
+// WithStmtLatency is used.
+const stmtLatencySize = int64(unsafe.Sizeof(stmtLatency{}))
+
+// LatencyStats contains the latency histograms of the queries executed via a
+// SQLStmtCache. The latency of a query is the time taken by the database/sql
+// method executing it (so, for queries returning rows, it does not include the
+// time taken to read the rows) and, if interceptors are used, it does not
+// include the time spent in them.
+type LatencyStats struct {
+	Hit  HistogramSnapshot // queries executed using prepared statements
+	Miss HistogramSnapshot // queries executed raw
+	// Statements contains the latency histograms of each statement currently
+	// tracked, sorted by number of executions (descending). It is empty unless
+	// WithStmtLatency is used.
+	Statements []StmtLatency
+}
+
+// StmtLatency contains the latency histograms of a single statement. They
+// include only the executions since the statement started being tracked.
+type StmtLatency struct {
+	Query string
+	Hit   HistogramSnapshot // executions that used the prepared statement
+	Miss  HistogramSnapshot // executions that did not use the prepared statement
+}
+
+// WithStmtLatency makes autoprepare keep, for each tracked statement, separate
+// latency histograms for the executions that used the prepared statement and for
+// the ones that did not: this allows to compare, for the same query, the latency
+// of prepared and raw executions. Each histogram uses about 1.4KB of memory,
+// that is accounted for by WithMaxTrackedBytes. The histograms are returned by
+// LatencyStats.
+func WithStmtLatency() SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		c.stmtLatency = true
+		return nil
+	}
+}
+
+// LatencyStats returns the latency histograms of the queries executed using
+// prepared statements and of the ones executed raw, and, if WithStmtLatency is
+// used, of each statement currently tracked. Histograms use HDR-style buckets
+// from 1µs to about 16.8s, whose bounds are at most 12.5% larger than the
+// durations they count. Collecting the per-statement histograms is expensive,
+// so this method should not be called often.
+func (c *SQLStmtCache) LatencyStats() LatencyStats {
+	ls := LatencyStats{
+		Hit:  c.latHit.snapshot(),
+		Miss: c.latMiss.snapshot(),
+	}
+	if !c.stmtLatency {
+		return ls
+	}
+
+	c.l.RLock()
+	ls.Statements = make([]StmtLatency, 0, c.stmt.len())
+	c.stmt.each(func(s *stmt) {
+		ls.Statements = append(ls.Statements, StmtLatency{
+			Query: s.q,
+			Hit:   s.lat.hit.snapshot(),
+			Miss:  s.lat.miss.snapshot(),
+		})
+	})
+	c.l.RUnlock()
+
+	sort.Slice(ls.Statements, func(i, j int) bool {
+		si, sj := &ls.Statements[i], &ls.Statements[j]
+		if ni, nj := si.Hit.Count+si.Miss.Count, sj.Hit.Count+sj.Miss.Count; ni != nj {
+			return ni > nj
+		}
+		return si.Query < sj.Query
+	})
+	return ls
+}
@@ -0,0 +1,63 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestLatencyStats(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dbsc, err := New(db, WithWorkerInterval(10*time.Millisecond), WithStmtLatency())
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := context.Background()
+	const hot, cold = "SELECT 1", "SELECT 2"
+
+	if _, err := dbsc.ExecContext(ctx, hot); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 100 && !dbsc.Snapshot()[0].Prepared; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := dbsc.ExecContext(ctx, hot); err != nil {
+			panic(err)
+		}
+	}
+	if _, err := dbsc.ExecContext(ctx, cold); err != nil {
+		panic(err)
+	}
+
+	ls := dbsc.LatencyStats()
+	if ls.Hit.Count != 3 || ls.Miss.Count != 2 {
+		t.Errorf("unexpected counts: hit %d, miss %d", ls.Hit.Count, ls.Miss.Count)
+	}
+	if len(ls.Statements) != 2 {
+		t.Fatalf("unexpected statements: %+v", ls.Statements)
+	}
+	if s := ls.Statements[0]; s.Query != hot || s.Hit.Count != 3 || s.Miss.Count != 1 || s.Hit.Sum <= 0 {
+		t.Errorf("unexpected latency of %q: hit %d, miss %d, sum %v", s.Query, s.Hit.Count, s.Miss.Count, s.Hit.Sum)
+	}
+	if s := ls.Statements[1]; s.Query != cold || s.Hit.Count != 0 || s.Miss.Count != 1 {
+		t.Errorf("unexpected latency of %q: hit %d, miss %d", s.Query, s.Hit.Count, s.Miss.Count)
+	}
+
+	// per-statement histograms are accounted for in the tracked memory
+	if st := dbsc.GetStats(); st.TrackedBytes != uint64(2*stmtLatencySize+trackedSize(hot)+trackedSize(cold)) {
+		t.Errorf("unexpected tracked bytes: %d", st.TrackedBytes)
+	}
+}
@@ -0,0 +1,262 @@
+package autoprepare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	errClosed        = errors.New("autoprepare: the SQLStmtCache is closed")
+	errDisabled      = errors.New("autoprepare: the SQLStmtCache is disabled")
+	errTooLong       = errors.New("autoprepare: the query is longer than allowed by WithMaxQueryLen")
+	errNotPreparable = errors.New("autoprepare: the query is not eligible to be prepared")
+	errTooManyPinned = errors.New("autoprepare: too many pinned statements")
+)
+
+// Invalidate stops tracking the SQL query and, if it was prepared, closes the
+// corresponding prepared statement. Invalidating a pinned statement also unpins it.
+// Invalidate returns whether the query was being tracked.
+func (c *SQLStmtCache) Invalidate(query string) bool {
+	var found bool
+	c.run(context.Background(), func() {
+		h := c.stmt.hash(query)
+		c.l.Lock()
+		s := c.stmt.get(query, h)
+		if s != nil {
+			c.untrack(s)
+		}
+		c.l.Unlock()
+		if s == nil {
+			return
+		}
+		found = true
+		if s.prepared() {
+			c.unprepare(s, ReasonInvalidated)
+		}
+		callHook(c.hooks.OnDrop, Event{Query: s.q, Reason: ReasonInvalidated})
+	})
+	return found
+}
+
+// Pin immediately prepares the SQL query, and ensures that the corresponding
+// prepared statement is never closed, regardless of how frequently the query is
+// executed. Pinned statements do not count towards the limit set by
+// WithMaxPreparedStmt, but towards the one set by WithMaxPinnedStmt: if that
+// limit has been reached, Pin fails. Pinning a statement that is already pinned
+// has no effect.
+// The context is used both to wait for the background worker and to prepare
+// the statement.
+func (c *SQLStmtCache) Pin(ctx context.Context, query string) error {
+	if atomic.LoadUint32(&c.maxPS) == 0 {
+		return errDisabled
+	}
+	if int64(len(query)) > atomic.LoadInt64(&c.maxSqlLen) {
+		return errTooLong
+	}
+	var err error
+	if !c.run(ctx, func() { err = c.pin(ctx, query) }) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errClosed
+	}
+	return err
+}
+
+// pin must be called only by the worker.
+func (c *sqlStmtCache) pin(ctx context.Context, query string) error {
+	h := c.stmt.hash(query)
+	c.l.RLock()
+	s := c.stmt.get(query, h)
+	c.l.RUnlock()
+	var eligible bool
+	if s == nil {
+		eligible = c.eligible(query)
+	}
+	c.l.Lock()
+	if c.stmt.closed() {
+		c.l.Unlock()
+		return errClosed
+	}
+	if s == nil {
+		s = c.stmt.get(query, h)
+	}
+	if s == nil {
+		// pinned statements are tracked even if the limits set by WithMaxStmt
+		// and WithMaxTrackedBytes have been reached
+		s = newStmt(c.intern(query), h, 0, atomic.LoadInt64(&c.now))
+		s.notPreparable = !eligible
+		c.track(s)
+	}
+	c.l.Unlock()
+
+	if s.notPreparable {
+		return errNotPreparable
+	}
+	if s.isPinned() {
+		return nil
+	}
+	if atomic.LoadUint32(&c.pinnedCount) >= c.maxPinned {
+		return errTooManyPinned
+	}
+	if s.prepared() {
+		// move it from the adaptive budget to the pinned one
+		atomic.AddUint32(&c.psCount, ^uint32(0))
+		s.pin()
+		atomic.AddUint32(&c.pinnedCount, 1)
+		return nil
+	}
+	s.pin()
+	if err := c.prepare(ctx, s); err != nil {
+		s.unpin()
+		return err
+	}
+	return nil
+}
+
+// Unpin makes the prepared statement of the SQL query, if it was pinned (see
+// Pin), subject again to the limit set by WithMaxPreparedStmt: the statement
+// stays prepared until it is replaced by more frequently executed ones. If the
+// limit is exceeded, the least frequently used prepared statements are closed.
+// Unpin returns whether the query was pinned.
+func (c *SQLStmtCache) Unpin(query string) bool {
+	var found bool
+	c.run(context.Background(), func() {
+		h := c.stmt.hash(query)
+		c.l.RLock()
+		s := c.stmt.get(query, h)
+		c.l.RUnlock()
+		if s == nil || !s.isPinned() {
+			return
+		}
+		found = true
+		atomic.AddUint32(&c.pinnedCount, ^uint32(0))
+		s.unpin()
+		atomic.AddUint32(&c.psCount, 1)
+		for atomic.LoadUint32(&c.psCount) > atomic.LoadUint32(&c.maxPS) {
+			victim := c.coldestUnpinned()
+			if victim == nil {
+				break
+			}
+			c.unprepare(victim, ReasonReplaced)
+		}
+	})
+	return found
+}
+
+// Freeze freezes the set of prepared statements: the background worker stops
+// preparing the most frequently executed statements and closing the other ones,
+// including the idle ones (see WithIdleTTL) and the ones that would be closed to
+// shrink the cache (see WithShrinkOnGC), while queries keep using the statements
+// that are already prepared and their execution frequency keeps being tracked.
+// This allows e.g. to keep the set of prepared statements stable during peak
+// hours, regardless of occasional batch jobs. Pin, Unpin, Invalidate and
+// ForcePrepare keep working as usual. Freeze takes effect from the next run of
+// the background worker.
+func (c *SQLStmtCache) Freeze() {
+	atomic.StoreUint32(&c.frozen, 1)
+}
+
+// Unfreeze reverts the effects of Freeze.
+func (c *SQLStmtCache) Unfreeze() {
+	atomic.StoreUint32(&c.frozen, 0)
+}
+
+// Pause stops tracking the execution frequency of the queries, reducing the
+// overhead of executing them: queries keep using the statements that are already
+// prepared, but new statements stop being tracked (these queries are counted in
+// SQLStmtCacheStats.Paused) and the background worker stops updating the set of
+// prepared statements, as it would be based on stale frequencies. Tracked
+// statements do not cool down while paused. Pin, Unpin and Invalidate keep
+// working as usual, while ForcePrepare is ignored.
+func (c *SQLStmtCache) Pause() {
+	atomic.StoreUint32(&c.paused, 1)
+}
+
+// Resume reverts the effects of Pause.
+func (c *SQLStmtCache) Resume() {
+	atomic.StoreUint32(&c.paused, 0)
+}
+
+// WithPinnedStatements makes the background worker pin (see Pin) the specified
+// SQL queries as soon as the SQLStmtCache is created. If a query fails to be
+// prepared, it is not pinned (see Hooks.OnPrepareError). New fails if a query is
+// longer than allowed by WithMaxQueryLen, if it is not eligible to be prepared,
+// or if there are more queries than allowed by WithMaxPinnedStmt.
+func WithPinnedStatements(queries ...string) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		c.toPin = append(c.toPin, queries...)
+		return nil
+	}
+}
+
+// WithMaxPinnedStmt specifies the maximum number of statements that can be
+// pinned (see Pin) at any one time. Pinned statements are not counted towards
+// the limit set by WithMaxPreparedStmt. It defaults to DefaultMaxPinnedStmt.
+func WithMaxPinnedStmt(max int) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if max > 1<<12 {
+			return errors.New("WithMaxPinnedStmt should be no more than 4096")
+		}
+		if max < 0 {
+			return errors.New("WithMaxPinnedStmt should be at least 0")
+		}
+		c.maxPinned = uint32(max)
+		return nil
+	}
+}
+
+// checkPinned checks the queries specified with WithPinnedStatements, once all
+// options have been applied.
+func (c *sqlStmtCache) checkPinned() error {
+	if len(c.toPin) > int(c.maxPinned) {
+		return errTooManyPinned
+	}
+	for _, q := range c.toPin {
+		if int64(len(q)) > c.maxSqlLen {
+			return fmt.Errorf("%w: %q", errTooLong, q)
+		}
+		if !c.eligible(q) {
+			return fmt.Errorf("%w: %q", errNotPreparable, q)
+		}
+	}
+	return nil
+}
+
+// pinStatements pins the queries specified with WithPinnedStatements. It must be
+// called only by the worker.
+func (c *sqlStmtCache) pinStatements() {
+	toPin := c.toPin
+	c.toPin = nil
+	if atomic.LoadUint32(&c.maxPS) == 0 {
+		return
+	}
+	for _, q := range toPin {
+		select {
+		case <-c.wrkStop:
+			return
+		default:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.prepareTimeout)
+		c.pin(ctx, q)
+		cancel()
+	}
+}
+
+// coldestUnpinned returns the least frequently used prepared statement that is
+// not pinned, if any.
+func (c *sqlStmtCache) coldestUnpinned() (victim *stmt) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	c.stmt.each(func(s *stmt) {
+		if s.isPinned() || !s.prepared() {
+			return
+		}
+		if victim == nil || atomic.LoadUint64(&victim.hit) > atomic.LoadUint64(&s.hit) {
+			victim = s
+		}
+	})
+	return
+}
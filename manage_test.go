@@ -0,0 +1,155 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPin(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	const pinned, other = "SELECT 1", "SELECT 2"
+	dbsc, err := New(db, WithMaxPreparedStmt(1), WithMaxPinnedStmt(2), WithPinnedStatements(pinned), WithWorkerInterval(10*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	for i := 0; i < 100 && dbsc.GetStats().PinnedStmts != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := dbsc.GetStats(); s.PinnedStmts != 1 || s.PreparedStmts != 1 {
+		t.Fatalf("statement not pinned: %+v", s)
+	}
+
+	// pinned statements do not count towards WithMaxPreparedStmt
+	if _, err := dbsc.ExecContext(context.Background(), other); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 100 && dbsc.GetStats().PreparedStmts != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := dbsc.GetStats(); s.PinnedStmts != 1 || s.PreparedStmts != 2 {
+		t.Fatalf("statement not prepared: %+v", s)
+	}
+
+	// pinning a prepared statement moves it to the pinned budget
+	if err := dbsc.Pin(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbsc.Pin(context.Background(), other); err != nil {
+		t.Errorf("pinning twice: %v", err)
+	}
+	if err := dbsc.Pin(context.Background(), "SELECT 3"); err != errTooManyPinned {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if s := dbsc.GetStats(); s.PinnedStmts != 2 || s.PreparedStmts != 2 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// unpinning both exceeds WithMaxPreparedStmt, so one of them is closed
+	if !dbsc.Unpin(pinned) || !dbsc.Unpin(other) {
+		t.Errorf("statements were not pinned")
+	}
+	if dbsc.Unpin(other) {
+		t.Errorf("statement unpinned twice")
+	}
+	if s := dbsc.GetStats(); s.PinnedStmts != 0 || s.PreparedStmts != 1 || s.Unprepared != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	for _, opts := range [][]SQLStmtCacheOpt{
+		{WithPinnedStatements("SELECT 1", "SELECT 2"), WithMaxPinnedStmt(1)},
+		{WithPinnedStatements("SELECT '" + strings.Repeat("x", 64) + "'"), WithMaxQueryLen(32)},
+		{WithPinnedStatements("SELECT 1"), WithDenyRules(PrefixRule("SELECT"))},
+		{WithMaxPinnedStmt(-1)},
+	} {
+		if _, err := New(db, opts...); err == nil {
+			t.Errorf("invalid options accepted")
+		}
+	}
+}
+
+func TestFreezeAndPause(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dbsc, err := New(db, WithMaxPreparedStmt(1), WithWorkerInterval(10*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	exec := func(query string, n int) {
+		for i := 0; i < n; i++ {
+			if _, err := dbsc.ExecContext(context.Background(), query); err != nil {
+				panic(err)
+			}
+		}
+	}
+	prepared := func() map[string]StmtStats {
+		m := map[string]StmtStats{}
+		for _, s := range dbsc.Snapshot() {
+			m[s.Query] = s
+		}
+		return m
+	}
+
+	exec("SELECT 1", 1)
+	for i := 0; i < 100 && !prepared()["SELECT 1"].Prepared; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// while frozen, the hotter statement does not replace the prepared one
+	dbsc.Freeze()
+	exec("SELECT 2", 100)
+	time.Sleep(50 * time.Millisecond)
+	if m := prepared(); !m["SELECT 1"].Prepared || m["SELECT 2"].Prepared {
+		t.Errorf("unexpected statements: %+v", m)
+	}
+	dbsc.Unfreeze()
+	exec("SELECT 2", 100)
+	for i := 0; i < 100 && !prepared()["SELECT 2"].Prepared; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := prepared(); m["SELECT 1"].Prepared || !m["SELECT 2"].Prepared {
+		t.Errorf("unexpected statements: %+v", m)
+	}
+
+	// while paused, new statements are not tracked, but prepared ones are used
+	dbsc.Pause()
+	time.Sleep(20 * time.Millisecond) // let the current run of the worker complete
+	heat := prepared()["SELECT 2"].Heat
+	hits := dbsc.GetStats().Hits
+	exec("SELECT 2", 10)
+	exec("SELECT 3", 10)
+	if m := prepared(); m["SELECT 2"].Heat != heat || len(m) != 2 {
+		t.Errorf("unexpected statements: %+v", m)
+	}
+	if s := dbsc.GetStats(); s.Hits != hits+10 || s.Paused != 10 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+	dbsc.Resume()
+	exec("SELECT 3", 1)
+	if m := prepared(); len(m) != 3 {
+		t.Errorf("unexpected statements: %+v", m)
+	}
+}
@@ -0,0 +1,195 @@
+package autoprepare
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// MetricLabel is a name/value pair used to distinguish metrics with the same name.
+type MetricLabel struct {
+	Name  string
+	Value string
+}
+
+// MetricsCollector receives the metrics exported by CollectMetrics. It allows to
+// export the metrics to any metrics system without autoprepare depending on it.
+// Metrics with the same name (and different labels) are always passed consecutively.
+// Metric names follow the Prometheus naming conventions.
+type MetricsCollector interface {
+	// Counter receives a monotonically increasing value.
+	Counter(name, help string, value float64, labels ...MetricLabel)
+	// Gauge receives a value that can go up and down.
+	Gauge(name, help string, value float64, labels ...MetricLabel)
+	// Histogram receives a latency histogram.
+	Histogram(name, help string, h HistogramSnapshot, labels ...MetricLabel)
+}
+
+// CollectMetrics passes to mc all metrics about the state and effectiveness of
+// the cache: the counters and gauges returned by GetStats, and the latency
+// histograms of the queries and of the creation and deletion of prepared statements.
+func (c *SQLStmtCache) CollectMetrics(mc MetricsCollector) {
+	s := c.GetStats()
+
+	mc.Counter("autoprepare_hits_total", "Number of SQL queries that used automatically-prepared statements.", float64(s.Hits))
+	mc.Counter("autoprepare_misses_total", "Number of SQL queries executed raw.", float64(s.Misses))
+	mc.Counter("autoprepare_skips_total", "Number of SQL queries that do not qualify for caching.", float64(s.Skips))
+	mc.Counter("autoprepare_prepared_total", "Number of automatically-prepared statements created.", float64(s.Prepared))
+	mc.Counter("autoprepare_unprepared_total", "Number of automatically-prepared statements closed.", float64(s.Unprepared))
+	mc.Counter("autoprepare_expired_total", "Number of statements that stopped being tracked because they were idle.", float64(s.Expired))
+	mc.Counter("autoprepare_shrinks_total", "Number of times the cache was shrunk because of GC or memory pressure.", float64(s.Shrinks))
+	mc.Counter("autoprepare_trimmed_total", "Number of statements that stopped being tracked because the cache was shrunk.", float64(s.Trimmed))
+	mc.Counter("autoprepare_would_prepare_total", "Number of statements that would have been prepared in shadow mode.", float64(s.WouldPrepare))
+	mc.Counter("autoprepare_would_unprepare_total", "Number of statements that would have been closed in shadow mode.", float64(s.WouldUnprepare))
+
+	const raw, rawHelp = "autoprepare_raw_queries_total", "Number of SQL queries executed raw, by reason."
+	for _, r := range []struct {
+		reason string
+		value  uint64
+	}{
+		{ReasonDisabled, s.Disabled},
+		{ReasonTooLong, s.TooLong},
+		{ReasonTableFull, s.TableFull},
+		{ReasonNotHot, s.NotHot},
+		{ReasonBlacklisted, s.Blacklisted},
+		{ReasonNotPreparable, s.NotPreparable},
+		{ReasonCanceled, s.Canceled},
+		{ReasonBypassed, s.Bypassed},
+		{ReasonWouldHit, s.WouldHit},
+		{ReasonPaused, s.Paused},
+	} {
+		mc.Counter(raw, rawHelp, float64(r.value), MetricLabel{"reason", r.reason})
+	}
+
+	mc.Gauge("autoprepare_tracked_statements", "Number of statements currently tracked.", float64(s.TrackedStmts))
+	mc.Gauge("autoprepare_prepared_statements", "Number of statements currently prepared.", float64(s.PreparedStmts))
+	mc.Gauge("autoprepare_pinned_statements", "Number of statements currently pinned.", float64(s.PinnedStmts))
+	mc.Gauge("autoprepare_tracked_bytes", "Approximate memory currently used to track statements.", float64(s.TrackedBytes))
+
+	const query, queryHelp = "autoprepare_query_duration_seconds", "Latency of the SQL queries, by whether they used a prepared statement."
+	mc.Histogram(query, queryHelp, c.latHit.snapshot(), MetricLabel{"result", "hit"})
+	mc.Histogram(query, queryHelp, c.latMiss.snapshot(), MetricLabel{"result", "miss"})
+	mc.Histogram("autoprepare_prepare_duration_seconds", "Latency of the creation of prepared statements.", c.latPrepare.snapshot())
+	mc.Histogram("autoprepare_unprepare_duration_seconds", "Latency of the eviction of prepared statements.", c.latUnprepare.snapshot())
+}
+
+// WritePrometheus writes all metrics returned by CollectMetrics to w, in the
+// Prometheus text exposition format. It can be used to serve the metrics via
+// HTTP, optionally together with other metrics, e.g.:
+//
+//	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+//		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+//		dbsc.WritePrometheus(w)
+//	})
+func (c *SQLStmtCache) WritePrometheus(w io.Writer) error {
+	pw := &promWriter{w: bufio.NewWriter(w)}
+	c.CollectMetrics(pw)
+	if pw.err != nil {
+		return pw.err
+	}
+	return pw.w.Flush()
+}
+
+// promWriter is a MetricsCollector that writes the metrics in the Prometheus
+// text exposition format.
+type promWriter struct {
+	w    *bufio.Writer
+	last string // name of the last metric written
+	err  error
+}
+
+func (pw *promWriter) Counter(name, help string, value float64, labels ...MetricLabel) {
+	pw.header(name, help, "counter")
+	pw.sample(name, labels, "", "", value)
+}
+
+func (pw *promWriter) Gauge(name, help string, value float64, labels ...MetricLabel) {
+	pw.header(name, help, "gauge")
+	pw.sample(name, labels, "", "", value)
+}
+
+func (pw *promWriter) Histogram(name, help string, h HistogramSnapshot, labels ...MetricLabel) {
+	pw.header(name, help, "histogram")
+	// to limit the number of series, only the buckets whose bound is a power of
+	// two multiple of histMin are exported (as buckets are cumulative, the other
+	// ones are implicitly merged into the next exported one)
+	var cum uint64
+	for i, b := range h.Bounds {
+		cum += h.Counts[i]
+		if b%histMin == 0 && bits.OnesCount64(uint64(b/histMin)) == 1 {
+			pw.sample(name+"_bucket", labels, "le", formatFloat(b.Seconds()), float64(cum))
+		}
+	}
+	pw.sample(name+"_bucket", labels, "le", "+Inf", float64(h.Count))
+	pw.sample(name+"_sum", labels, "", "", h.Sum.Seconds())
+	pw.sample(name+"_count", labels, "", "", float64(h.Count))
+}
+
+func (pw *promWriter) header(name, help, typ string) {
+	if pw.last == name {
+		return
+	}
+	pw.last = name
+	pw.printf("# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+}
+
+// sample writes a single sample. If extra is not empty, the label extra=extraValue
+// is added to labels.
+func (pw *promWriter) sample(name string, labels []MetricLabel, extra, extraValue string, value float64) {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(labels) > 0 || extra != "" {
+		sb.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(l.Name)
+			sb.WriteString(`="`)
+			sb.WriteString(escapeLabel(l.Value))
+			sb.WriteByte('"')
+		}
+		if extra != "" {
+			if len(labels) > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(extra)
+			sb.WriteString(`="`)
+			sb.WriteString(extraValue)
+			sb.WriteByte('"')
+		}
+		sb.WriteByte('}')
+	}
+	pw.printf("%s %s\n", sb.String(), formatFloat(value))
+}
+
+func (pw *promWriter) printf(format string, args ...interface{}) {
+	if pw.err != nil {
+		return
+	}
+	_, pw.err = fmt.Fprintf(pw.w, format, args...)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
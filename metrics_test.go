@@ -0,0 +1,122 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dbsc, err := New(db)
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	if _, err := dbsc.ExecContext(context.Background(), "SELECT 1"); err != nil {
+		panic(err)
+	}
+
+	var buf strings.Builder
+	if err := dbsc.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, exp := range []string{
+		"# TYPE autoprepare_misses_total counter\nautoprepare_misses_total 1\n",
+		"# TYPE autoprepare_tracked_statements gauge\nautoprepare_tracked_statements 1\n",
+		`autoprepare_raw_queries_total{reason="not_hot"} 1` + "\n",
+		`autoprepare_query_duration_seconds_bucket{result="miss",le="+Inf"} 1` + "\n",
+		`autoprepare_query_duration_seconds_count{result="miss"} 1` + "\n",
+		`autoprepare_query_duration_seconds_count{result="hit"} 0` + "\n",
+		"# TYPE autoprepare_prepare_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(out, exp) {
+			t.Errorf("missing %q in output:\n%s", exp, out)
+		}
+	}
+	for _, name := range []string{"autoprepare_raw_queries_total", "autoprepare_query_duration_seconds"} {
+		if n := strings.Count(out, "# TYPE "+name+" "); n != 1 {
+			t.Errorf("metric %s declared %d times", name, n)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for _, d := range []time.Duration{0, time.Microsecond, 1500 * time.Nanosecond, 2 * time.Microsecond, 3 * time.Microsecond, time.Hour} {
+		h.observe(d)
+	}
+	s := h.snapshot()
+	if s.Count != 6 || s.Sum != time.Hour+7500*time.Nanosecond {
+		t.Errorf("unexpected count or sum: %d, %v", s.Count, s.Sum)
+	}
+	exp := map[int]uint64{0: 2, 1: 2, 2: 1, histBuckets - 1: 1}
+	for i, n := range s.Counts {
+		if n != exp[i] {
+			t.Errorf("bucket %d: got %d, want %d", i, n, exp[i])
+		}
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	if len(histBounds) != histBuckets-1 || histBounds[len(histBounds)-1] != histMin<<histOctaves {
+		t.Fatalf("unexpected bounds: %v", histBounds)
+	}
+	for i, b := range histBounds {
+		if i > 0 && b <= histBounds[i-1] {
+			t.Fatalf("bounds not increasing at %d: %v", i, histBounds)
+		}
+		if i >= histSub && b-histBounds[i-1] > b/histSub {
+			t.Errorf("bucket %d too wide: (%v, %v]", i, histBounds[i-1], b)
+		}
+		// every bound must be counted in its bucket, and the next duration in the next one
+		if got := histBucket(b); got != i {
+			t.Errorf("histBucket(%v): got %d, want %d", b, got, i)
+		}
+		if got := histBucket(b + 1); got != i+1 {
+			t.Errorf("histBucket(%v): got %d, want %d", b+1, got, i+1)
+		}
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	var h histogram
+	if s := h.snapshot(); s.Quantile(0.5) != 0 || s.Mean() != 0 {
+		t.Errorf("unexpected quantile or mean of empty histogram: %v, %v", s.Quantile(0.5), s.Mean())
+	}
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	s := h.snapshot()
+	for _, c := range []struct {
+		q   float64
+		exp time.Duration
+	}{
+		{0, time.Millisecond},
+		{0.5, 50 * time.Millisecond},
+		{0.99, 99 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+	} {
+		// the quantile is an upper bound, at most 12.5% larger than the exact value
+		if got := s.Quantile(c.q); got < c.exp || got > c.exp+c.exp/histSub {
+			t.Errorf("quantile %v: got %v, want %v", c.q, got, c.exp)
+		}
+	}
+	if m := s.Mean(); m != 50500*time.Microsecond {
+		t.Errorf("unexpected mean: %v", m)
+	}
+}
@@ -0,0 +1,120 @@
+package autoprepare
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+)
+
+// A Limit is a limit of the SQLStmtCache that can be changed at runtime by
+// Reconfigure. Each Limit is equivalent to the option with the same name, e.g.
+// MaxPreparedStmt(n) to WithMaxPreparedStmt(n).
+type Limit struct {
+	opt SQLStmtCacheOpt
+}
+
+// MaxPreparedStmt is the Limit equivalent to WithMaxPreparedStmt.
+func MaxPreparedStmt(max int) Limit {
+	return Limit{WithMaxPreparedStmt(max)}
+}
+
+// MaxStmt is the Limit equivalent to WithMaxStmt.
+func MaxStmt(max int) Limit {
+	return Limit{WithMaxStmt(max)}
+}
+
+// MaxTrackedBytes is the Limit equivalent to WithMaxTrackedBytes.
+func MaxTrackedBytes(max int) Limit {
+	return Limit{WithMaxTrackedBytes(max)}
+}
+
+// MaxQueryLen is the Limit equivalent to WithMaxQueryLen.
+func MaxQueryLen(max int) Limit {
+	return Limit{WithMaxQueryLen(max)}
+}
+
+// WorkerThreshold is the Limit equivalent to WithWorkerThreshold.
+func WorkerThreshold(n int) Limit {
+	return Limit{WithWorkerThreshold(n)}
+}
+
+// Reconfigure changes the limits of the SQLStmtCache at runtime, without losing
+// the statistics collected so far. If any limit is invalid, Reconfigure fails
+// without changing anything; otherwise all the limits are applied at once.
+//
+// If the limits are lowered, the least frequently used statements exceeding
+// them are closed (for prepared statements) and stop being tracked, as if they
+// had been replaced. Tracked statements longer than the new MaxQueryLen stop
+// being tracked, even if they are pinned. Reconfigure waits for the background
+// worker to apply the new limits.
+func (c *SQLStmtCache) Reconfigure(limits ...Limit) error {
+	// apply the limits to an empty cache, with values that can not be set by
+	// the options, to detect which ones have been set
+	n := &SQLStmtCache{&sqlStmtCache{
+		maxPS:     math.MaxUint32,
+		maxSqlLen: -1,
+		maxStmt:   -1,
+		maxBytes:  -1,
+	}}
+	for _, l := range limits {
+		if err := l.opt(n); err != nil {
+			return err
+		}
+	}
+	maxPS, maxSqlLen, maxStmt, maxBytes, wrkThreshold := n.maxPS, n.maxSqlLen, n.maxStmt, n.maxBytes, n.wrkThreshold
+
+	if !c.run(context.Background(), func() {
+		if maxPS != math.MaxUint32 {
+			atomic.StoreUint32(&c.maxPS, maxPS)
+		}
+		if maxSqlLen >= 0 {
+			atomic.StoreInt64(&c.maxSqlLen, maxSqlLen)
+		}
+		if maxStmt >= 0 {
+			atomic.StoreInt64(&c.maxStmt, maxStmt)
+		}
+		if maxBytes >= 0 {
+			atomic.StoreInt64(&c.maxBytes, maxBytes)
+		}
+		if wrkThreshold != 0 {
+			atomic.StoreUint32(&c.wrkThreshold, wrkThreshold)
+		}
+		c.applyLimits()
+	}) {
+		return errClosed
+	}
+	return nil
+}
+
+// applyLimits closes the prepared statements, and stops tracking the statements,
+// that exceed the limits. It must be called only by the worker.
+func (c *sqlStmtCache) applyLimits() {
+	maxSqlLen := atomic.LoadInt64(&c.maxSqlLen)
+	var tooLong []*stmt
+	c.l.Lock()
+	c.stmt.each(func(s *stmt) {
+		if int64(len(s.q)) > maxSqlLen {
+			tooLong = append(tooLong, s)
+		}
+	})
+	for _, s := range tooLong {
+		c.untrack(s)
+	}
+	c.l.Unlock()
+	for _, s := range tooLong {
+		if s.prepared() {
+			c.unprepare(s, ReasonReconfigured)
+		}
+		callHook(c.hooks.OnDrop, Event{Query: s.q, Reason: ReasonReconfigured})
+	}
+
+	for atomic.LoadUint32(&c.psCount) > atomic.LoadUint32(&c.maxPS) {
+		victim := c.coldestUnpinned()
+		if victim == nil {
+			break
+		}
+		c.unprepare(victim, ReasonReconfigured)
+	}
+
+	c.dropStmts(2, ReasonReconfigured)
+}
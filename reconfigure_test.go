@@ -0,0 +1,74 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconfigure(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dbsc, err := New(db, WithMaxPreparedStmt(2), WithWorkerInterval(time.Hour))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	long := "SELECT '" + strings.Repeat("x", 64) + "'"
+	for _, q := range []string{"SELECT 1", long} {
+		if _, err := dbsc.ExecContext(ForcePrepare(context.Background()), q); err != nil {
+			panic(err)
+		}
+	}
+	if s := dbsc.GetStats(); s.PreparedStmts != 2 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	if err := dbsc.Reconfigure(MaxPreparedStmt(1), MaxStmt(1)); err == nil {
+		t.Errorf("invalid limit accepted")
+	}
+	if s := dbsc.GetStats(); s.PreparedStmts != 2 || dbsc.maxPS != 2 {
+		t.Errorf("limits changed by failed Reconfigure: %+v", s)
+	}
+
+	// the long statement is dropped, and then the limit is not exceeded anymore
+	if err := dbsc.Reconfigure(MaxPreparedStmt(1), MaxQueryLen(32)); err != nil {
+		t.Fatal(err)
+	}
+	if snap := dbsc.Snapshot(); len(snap) != 1 || snap[0].Query != "SELECT 1" || !snap[0].Prepared {
+		t.Errorf("unexpected statements: %+v", snap)
+	}
+	if s := dbsc.GetStats(); s.PreparedStmts != 1 || s.Unprepared != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	if err := dbsc.Reconfigure(MaxPreparedStmt(0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbsc.ExecContext(context.Background(), "SELECT 1"); err != nil {
+		panic(err)
+	}
+	if s := dbsc.GetStats(); s.PreparedStmts != 0 || s.Unprepared != 2 || s.Disabled != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	if err := dbsc.Reconfigure(WorkerThreshold(10)); err != nil || dbsc.wrkThreshold != 10 {
+		t.Errorf("worker threshold not changed: %v", err)
+	}
+
+	dbsc.Close()
+	if err := dbsc.Reconfigure(MaxPreparedStmt(1)); err != errClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+package autoprepare
+
+// WithShadowMode makes the SQLStmtCache run in shadow (dry-run) mode: statements
+// are tracked, and the statements to prepare and to close are picked as usual,
+// but no statement is actually prepared, and all queries are executed raw. This
+// allows to check what autoprepare would do with a given configuration, without
+// affecting the database.
+//
+// The statements that would be prepared are reported as prepared by Snapshot and
+// by SQLStmtCacheStats.PreparedStmts, while the decisions are counted in
+// SQLStmtCacheStats.WouldPrepare and WouldUnprepare instead of Prepared and
+// Unprepared, and the queries that would have used a prepared statement are
+// counted in WouldHit. Hooks.OnPrepare and Hooks.OnEvict are called with
+// Event.Shadow set.
+func WithShadowMode() SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		c.shadow = true
+		return nil
+	}
+}
+
+// unpreparedCount returns the counter of the closed prepared statements.
+func (c *sqlStmtCache) unpreparedCount() *uint64 {
+	if c.shadow {
+		return &c.stats.WouldUnprepare
+	}
+	return &c.stats.Unprepared
+}
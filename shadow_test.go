@@ -0,0 +1,66 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShadowMode(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	var prepared, evicted uint32
+	hooks := Hooks{
+		OnPrepare: func(e Event) {
+			if e.Shadow {
+				atomic.AddUint32(&prepared, 1)
+			}
+		},
+		OnEvict: func(e Event) {
+			if e.Shadow {
+				atomic.AddUint32(&evicted, 1)
+			}
+		},
+	}
+	dbsc, err := New(db, WithShadowMode(), WithHooks(hooks), WithWorkerInterval(10*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	const query = "SELECT 1"
+	for i := 0; i < 100 && dbsc.GetStats().PreparedStmts != 1; i++ {
+		if _, err := dbsc.ExecContext(context.Background(), query); err != nil {
+			panic(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := dbsc.ExecContext(context.Background(), query); err != nil {
+		panic(err)
+	}
+
+	if snap := dbsc.Snapshot(); len(snap) != 1 || !snap[0].Prepared || snap[0].Hits != 0 {
+		t.Errorf("unexpected statements: %+v", snap)
+	}
+	if s := dbsc.GetStats(); s.Hits != 0 || s.Prepared != 0 || s.WouldPrepare != 1 || s.WouldHit == 0 || s.WouldHit >= s.Misses {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	dbsc.Invalidate(query)
+	if s := dbsc.GetStats(); s.Unprepared != 0 || s.WouldUnprepare != 1 || s.PreparedStmts != 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+	if p, e := atomic.LoadUint32(&prepared), atomic.LoadUint32(&evicted); p != 1 || e != 1 {
+		t.Errorf("unexpected hooks: %d prepared, %d evicted", p, e)
+	}
+}
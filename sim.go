@@ -0,0 +1,231 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSimReportInterval is the default interval used by the Simulator to
+// report the hit ratio over time.
+const DefaultSimReportInterval = time.Minute
+
+// SimOptions configures a Simulator.
+type SimOptions struct {
+	// Options of the simulated SQLStmtCache, e.g. WithMaxPreparedStmt and WithMaxStmt.
+	Options []SQLStmtCacheOpt
+	// ReportInterval is the length of the intervals of SimReport.Intervals.
+	// If 0, DefaultSimReportInterval is used.
+	ReportInterval time.Duration
+}
+
+// SimInterval contains the statistics of the queries simulated in an interval.
+type SimInterval struct {
+	Start   time.Time
+	Queries uint64
+	Hits    uint64
+}
+
+// HitRatio returns the fraction of the queries that used a prepared statement.
+func (i SimInterval) HitRatio() float64 {
+	if i.Queries == 0 {
+		return 0
+	}
+	return float64(i.Hits) / float64(i.Queries)
+}
+
+// SimReport contains the results of a simulation.
+type SimReport struct {
+	SimInterval // all queries
+
+	// Intervals contains the statistics of each interval of length
+	// SimOptions.ReportInterval, starting from the first query. Intervals
+	// without queries are included.
+	Intervals []SimInterval
+
+	// WarmUp is the time from the first query to the end of the first interval
+	// whose hit ratio was at least 90% of the highest hit ratio of all intervals.
+	// It is 0 if no query used a prepared statement.
+	WarmUp time.Duration
+
+	Prepared         uint64 // number of statements prepared
+	Unprepared       uint64 // number of prepared statements closed
+	PeakPrepared     int    // maximum number of statements prepared at the same time
+	PeakTrackedStmts int    // maximum number of statements tracked at the same time
+	PeakTrackedBytes int64  // maximum memory used to track statements
+}
+
+// Simulator replays a workload through the policy used by SQLStmtCache to pick
+// the statements to prepare, using a simulated clock and without a database.
+// This allows to evaluate offline the effect of the options on a workload (e.g.
+// recorded with WithTraceRecorder). The background worker runs synchronously
+// when it would be triggered by the number of queries or by the passage of
+// (simulated) time. A Simulator is not safe for concurrent use, and it should be
+// closed with Close once it is not needed anymore.
+type Simulator struct {
+	c        *SQLStmtCache
+	now      time.Time // simulated clock
+	lastTick time.Time // last time the worker was triggered by the ticker
+	interval time.Duration
+	report   SimReport
+	started  bool
+}
+
+// NewSimulator creates a new Simulator.
+func NewSimulator(o SimOptions) (*Simulator, error) {
+	if o.ReportInterval < 0 {
+		return nil, errors.New("ReportInterval should be at least 0")
+	}
+	sim := &Simulator{interval: o.ReportInterval}
+	if sim.interval == 0 {
+		sim.interval = DefaultSimReportInterval
+	}
+	db := sql.OpenDB(simConnector{})
+	c, err := newSQLStmtCache(db, func() time.Time { return sim.now }, o.Options)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	sim.c = c
+	c.pinStatements()
+	return sim, nil
+}
+
+// Query simulates the execution of query at time t, and returns whether it used
+// a prepared statement. Queries must be simulated in chronological order: if t
+// is before the time of the previous query, the time of the previous query is used.
+func (sim *Simulator) Query(t time.Time, query string) bool {
+	c := sim.c
+	if !sim.started {
+		sim.started = true
+		sim.now, sim.lastTick = t, t
+		c.lastDecay = t
+		atomic.StoreInt64(&c.now, t.UnixNano())
+		sim.report.Start = t
+	}
+	if t.After(sim.now) {
+		sim.now = t
+	}
+	for sim.now.Sub(sim.lastTick) >= c.wrkInterval {
+		sim.lastTick = sim.lastTick.Add(c.wrkInterval)
+		sim.wrk(true)
+	}
+
+	s := c.getPS(context.Background(), query)
+	hit := s.acquire() != nil
+	if hit {
+		s.release()
+		c.countHit(s, 0)
+	} else {
+		c.countMiss(s, 0)
+	}
+	select {
+	case <-c.wrkSignal:
+		sim.wrk(false)
+	default:
+	}
+
+	sim.count(hit)
+	return hit
+}
+
+func (sim *Simulator) wrk(tick bool) {
+	// the ticker fires at the simulated time of the tick
+	now := sim.now
+	if tick {
+		sim.now = sim.lastTick
+	}
+	sim.c.wrk(tick)
+	sim.now = now
+
+	r := &sim.report
+	if n := int(atomic.LoadUint32(&sim.c.psCount) + atomic.LoadUint32(&sim.c.pinnedCount)); n > r.PeakPrepared {
+		r.PeakPrepared = n
+	}
+}
+
+func (sim *Simulator) count(hit bool) {
+	r := &sim.report
+	for i := int(sim.now.Sub(r.Start) / sim.interval); len(r.Intervals) <= i; {
+		r.Intervals = append(r.Intervals, SimInterval{Start: r.Start.Add(time.Duration(len(r.Intervals)) * sim.interval)})
+	}
+	cur := &r.Intervals[len(r.Intervals)-1]
+	cur.Queries++
+	r.Queries++
+	if hit {
+		cur.Hits++
+		r.Hits++
+	}
+
+	if n := sim.c.stmt.len(); n > r.PeakTrackedStmts {
+		r.PeakTrackedStmts = n
+	}
+	if n := atomic.LoadInt64(&sim.c.trackedBytes); n > r.PeakTrackedBytes {
+		r.PeakTrackedBytes = n
+	}
+}
+
+// Report returns the results of the simulation so far.
+func (sim *Simulator) Report() SimReport {
+	r := sim.report
+	r.Intervals = append([]SimInterval(nil), r.Intervals...)
+	r.Prepared = atomic.LoadUint64(&sim.c.stats.Prepared)
+	r.Unprepared = atomic.LoadUint64(&sim.c.stats.Unprepared)
+
+	var best float64
+	for _, i := range r.Intervals {
+		if hr := i.HitRatio(); hr > best {
+			best = hr
+		}
+	}
+	if best > 0 {
+		for _, i := range r.Intervals {
+			if i.HitRatio() >= best*0.9 {
+				r.WarmUp = i.Start.Add(sim.interval).Sub(r.Start)
+				break
+			}
+		}
+	}
+	return r
+}
+
+// Close releases the resources used by the Simulator. It must not be used
+// after Close has been called.
+func (sim *Simulator) Close() {
+	sim.c.c.Close()
+}
+
+// Statements returns the statements currently tracked by the simulated cache,
+// as returned by (*SQLStmtCache).Snapshot.
+func (sim *Simulator) Statements() []StmtStats {
+	return sim.c.Snapshot()
+}
+
+// simConnector is a database/sql driver that can only prepare statements, used
+// by the Simulator instead of a real database.
+type simConnector struct{}
+
+func (simConnector) Connect(context.Context) (driver.Conn, error) { return simConn{}, nil }
+func (simConnector) Driver() driver.Driver                        { return simDriver{} }
+
+type simDriver struct{}
+
+func (simDriver) Open(string) (driver.Conn, error) { return simConn{}, nil }
+
+type simConn struct{}
+
+func (simConn) Prepare(string) (driver.Stmt, error) { return simStmt{}, nil }
+func (simConn) Close() error                        { return nil }
+func (simConn) Begin() (driver.Tx, error)           { return nil, errSimulated }
+
+type simStmt struct{}
+
+func (simStmt) Close() error                               { return nil }
+func (simStmt) NumInput() int                              { return -1 }
+func (simStmt) Exec([]driver.Value) (driver.Result, error) { return nil, errSimulated }
+func (simStmt) Query([]driver.Value) (driver.Rows, error)  { return nil, errSimulated }
+
+var errSimulated = errors.New("autoprepare: queries can not be executed by the Simulator")
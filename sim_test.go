@@ -0,0 +1,108 @@
+package autoprepare
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimulator(t *testing.T) {
+	sim, err := NewSimulator(SimOptions{
+		Options:        []SQLStmtCacheOpt{WithMaxPreparedStmt(1), WithWorkerInterval(time.Minute), WithWorkerThreshold(100)},
+		ReportInterval: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	// 10 queries per second for 10 seconds: the hot query is prepared when the
+	// worker runs after 100 queries
+	start := time.Unix(1000, 0)
+	var firstHit int
+	for i := 0; i < 100; i++ {
+		q := "SELECT 1"
+		if i%10 == 9 {
+			q = "SELECT 2"
+		}
+		if sim.Query(start.Add(time.Duration(i)*100*time.Millisecond), q) && firstHit == 0 {
+			firstHit = i
+		}
+	}
+	if r := sim.Report(); r.Queries != 100 || r.Hits != 0 || r.Prepared != 0 || len(r.Intervals) != 10 {
+		t.Fatalf("unexpected report before the worker ran: %+v", r)
+	}
+	sim.Query(start.Add(10*time.Second), "SELECT 1")
+	if !sim.Query(start.Add(10*time.Second), "SELECT 1") {
+		t.Fatalf("query not prepared after the worker ran")
+	}
+
+	// only hits from now on
+	for i := 0; i < 5; i++ {
+		sim.Query(start.Add(time.Duration(11+i)*time.Second), "SELECT 1")
+	}
+
+	r := sim.Report()
+	if r.Queries != 107 || r.Hits != 6 || r.Prepared != 1 || r.Unprepared != 0 {
+		t.Errorf("unexpected report: %+v", r)
+	}
+	if len(r.Intervals) != 16 || r.Intervals[10].Queries != 2 || r.Intervals[10].Hits != 1 || r.Intervals[15].HitRatio() != 1 {
+		t.Errorf("unexpected intervals: %+v", r.Intervals)
+	}
+	// the first interval with a hit ratio of at least 90% is [11s, 12s)
+	if r.WarmUp != 12*time.Second {
+		t.Errorf("unexpected warm-up: %v", r.WarmUp)
+	}
+	if r.PeakPrepared != 1 || r.PeakTrackedStmts != 2 || r.PeakTrackedBytes != trackedSize("SELECT 1")+trackedSize("SELECT 2") {
+		t.Errorf("unexpected peaks: %+v", r)
+	}
+
+	st := sim.Statements()
+	if len(st) != 2 || st[0].Query != "SELECT 1" || !st[0].Prepared || st[0].PreparedAt != start.Add(10*time.Second) {
+		t.Errorf("unexpected statements: %+v", st)
+	}
+}
+
+func TestSimulatorTicker(t *testing.T) {
+	sim, err := NewSimulator(SimOptions{
+		Options: []SQLStmtCacheOpt{WithWorkerInterval(time.Minute), WithIdleTTL(time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	start := time.Unix(1000, 0)
+	sim.Query(start, "SELECT 1")
+	// the worker, triggered by the ticker, prepares the statement
+	if !sim.Query(start.Add(time.Minute), "SELECT 1") {
+		t.Errorf("query not prepared by the ticker")
+	}
+	// after two idle hours the statement expires
+	sim.Query(start.Add(2*time.Hour), "SELECT 2")
+	if r := sim.Report(); r.Unprepared != 1 || len(sim.Statements()) != 1 {
+		t.Errorf("idle statement not expired: %+v, %+v", r, sim.Statements())
+	}
+}
+
+func TestSimulatorIdleTTL(t *testing.T) {
+	if _, err := NewSimulator(SimOptions{Options: []SQLStmtCacheOpt{WithIdleTTL(DefaultWorkerInterval)}}); err == nil {
+		t.Errorf("TTL shorter than twice the worker interval accepted")
+	}
+
+	sim, err := NewSimulator(SimOptions{
+		Options: []SQLStmtCacheOpt{WithIdleTTL(2 * DefaultWorkerInterval)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	// a statement in constant use is never expired, even if the TTL is short
+	start := time.Unix(1000, 0)
+	for i := 0; i < 1200; i++ {
+		sim.Query(start.Add(time.Duration(i)*100*time.Millisecond), "SELECT 1")
+	}
+	if r := sim.Report(); r.Prepared != 1 || r.Unprepared != 0 || r.HitRatio() < 0.9 {
+		t.Errorf("statement in use expired: %+v", r)
+	}
+}
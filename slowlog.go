@@ -0,0 +1,125 @@
+package autoprepare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SlowQuery describes a query that took longer than the threshold specified with
+// WithSlowQueryLog.
+type SlowQuery struct {
+	Time     time.Time     // when the query started
+	Query    string        // SQL query
+	Args     []string      // arguments of the query, formatted with %v; "?" unless WithSlowQueryArgs is used
+	Duration time.Duration // time taken to execute the query
+	Prepared bool          // whether the query used an automatically-prepared statement
+	Heat     uint64        // current heat of the statement (see StmtStats); 0 if the statement is not tracked
+	Labels   []MetricLabel // labels attached to the context of the query (see WithLabel)
+	Err      error         // error returned by the query, if any
+}
+
+// SlowQuerySink receives the queries logged by the slow query log.
+// LogSlowQuery is called synchronously by the goroutine that executed the query,
+// so it should return quickly.
+type SlowQuerySink interface {
+	LogSlowQuery(SlowQuery)
+}
+
+// SlowQuerySinkFunc is an adapter to allow the use of ordinary functions as
+// SlowQuerySinks.
+type SlowQuerySinkFunc func(SlowQuery)
+
+// LogSlowQuery calls f(q).
+func (f SlowQuerySinkFunc) LogSlowQuery(q SlowQuery) {
+	f(q)
+}
+
+// SlowQueryLogger returns a SlowQuerySink that writes the slow queries to l,
+// one per line. If l is nil, the standard logger is used.
+func SlowQueryLogger(l *log.Logger) SlowQuerySink {
+	return SlowQuerySinkFunc(func(q SlowQuery) {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "autoprepare: slow query (%v, ", q.Duration)
+		if q.Prepared {
+			sb.WriteString("prepared")
+		} else {
+			sb.WriteString("raw")
+		}
+		fmt.Fprintf(&sb, ", heat %d", q.Heat)
+		for _, l := range q.Labels {
+			fmt.Fprintf(&sb, ", %s=%q", l.Name, l.Value)
+		}
+		fmt.Fprintf(&sb, "): %q", q.Query)
+		if len(q.Args) > 0 {
+			fmt.Fprintf(&sb, " [%s]", strings.Join(q.Args, ", "))
+		}
+		if q.Err != nil {
+			fmt.Fprintf(&sb, ": %v", q.Err)
+		}
+		if l == nil {
+			log.Print(sb.String())
+		} else {
+			l.Print(sb.String())
+		}
+	})
+}
+
+// WithSlowQueryLog makes autoprepare pass to sink all queries that take at least
+// threshold to execute (see LatencyStats for how the latency of queries is
+// measured). To avoid leaking sensitive data, the values of the arguments of the
+// queries are not passed to sink, unless WithSlowQueryArgs is used.
+func WithSlowQueryLog(threshold time.Duration, sink SlowQuerySink) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if threshold < 0 {
+			return errors.New("WithSlowQueryLog threshold should be at least 0")
+		}
+		if sink == nil {
+			return errors.New("WithSlowQueryLog sink should not be nil")
+		}
+		c.slowThreshold = threshold
+		c.slowSink = sink
+		return nil
+	}
+}
+
+// WithSlowQueryArgs makes the slow query log (see WithSlowQueryLog) include the
+// values of the arguments of the queries. They may contain sensitive data.
+func WithSlowQueryArgs() SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		c.slowArgs = true
+		return nil
+	}
+}
+
+// logSlowQuery passes call, executed using s (nil if not tracked), to the slow
+// query log if it took too long.
+func (c *sqlStmtCache) logSlowQuery(ctx context.Context, s *stmt, call *Call, err error) {
+	if c.slowSink == nil || call.dur < c.slowThreshold {
+		return
+	}
+	q := SlowQuery{
+		Time:     time.Now().Add(-call.dur),
+		Query:    call.Query,
+		Args:     make([]string, len(call.Args)),
+		Duration: call.dur,
+		Prepared: call.ps != nil,
+		Labels:   ContextLabels(ctx),
+		Err:      err,
+	}
+	for i, a := range call.Args {
+		if c.slowArgs {
+			q.Args[i] = fmt.Sprintf("%v", a)
+		} else {
+			q.Args[i] = "?"
+		}
+	}
+	if s != nil {
+		q.Heat = atomic.LoadUint64(&s.hit)
+	}
+	c.slowSink.LogSlowQuery(q)
+}
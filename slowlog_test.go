@@ -0,0 +1,90 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowQueryLog(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	for _, withArgs := range []bool{false, true} {
+		var logged []SlowQuery
+		opts := []SQLStmtCacheOpt{
+			WithSlowQueryLog(0, SlowQuerySinkFunc(func(q SlowQuery) { logged = append(logged, q) })),
+		}
+		if withArgs {
+			opts = append(opts, WithSlowQueryArgs())
+		}
+		dbsc, err := New(db, opts...)
+		if err != nil {
+			panic(err)
+		}
+
+		ctx := WithLabel(context.Background(), "tenant", "a")
+		const query = "SELECT ?, ?"
+		start := time.Now()
+		if _, err := dbsc.ExecContext(ctx, query, 42, "secret"); err != nil {
+			panic(err)
+		}
+		dbsc.Close()
+
+		if len(logged) != 1 {
+			t.Fatalf("unexpected slow queries: %+v", logged)
+		}
+		q := logged[0]
+		expArgs := []string{"?", "?"}
+		if withArgs {
+			expArgs = []string{"42", "secret"}
+		}
+		if q.Query != query || !reflect.DeepEqual(q.Args, expArgs) || q.Prepared || q.Heat != 1 || q.Err != nil {
+			t.Errorf("unexpected slow query: %+v", q)
+		}
+		if q.Duration <= 0 || q.Time.Before(start) || q.Time.After(time.Now()) {
+			t.Errorf("unexpected time or duration: %v, %v", q.Time, q.Duration)
+		}
+		if !reflect.DeepEqual(q.Labels, []MetricLabel{{"tenant", "a"}}) {
+			t.Errorf("unexpected labels: %v", q.Labels)
+		}
+	}
+}
+
+func TestSlowQueryLogThreshold(t *testing.T) {
+	if _, err := New(nil, WithSlowQueryLog(time.Second, nil)); err == nil {
+		t.Errorf("nil sink accepted")
+	}
+
+	c := &sqlStmtCache{slowThreshold: time.Second, slowSink: SlowQuerySinkFunc(func(q SlowQuery) {
+		t.Errorf("unexpected slow query: %+v", q)
+	})}
+	c.logSlowQuery(context.Background(), nil, &Call{Query: "SELECT 1", dur: time.Second - 1}, nil)
+}
+
+func TestSlowQueryLogger(t *testing.T) {
+	var sb strings.Builder
+	sink := SlowQueryLogger(log.New(&sb, "", 0))
+	sink.LogSlowQuery(SlowQuery{
+		Query:    "SELECT ?",
+		Args:     []string{"?"},
+		Duration: 1500 * time.Millisecond,
+		Prepared: true,
+		Heat:     7,
+		Labels:   []MetricLabel{{"tenant", "a"}},
+	})
+	if exp := `autoprepare: slow query (1.5s, prepared, heat 7, tenant="a"): "SELECT ?" [?]` + "\n"; sb.String() != exp {
+		t.Errorf("unexpected output: got %q, want %q", sb.String(), exp)
+	}
+}
@@ -0,0 +1,68 @@
+package autoprepare
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// StmtStats contains statistics about a single statement tracked by a SQLStmtCache.
+// Hits, Misses and PrepareErrors are counted since the statement started being
+// tracked.
+type StmtStats struct {
+	Query            string    // SQL query
+	Heat             uint64    // decayed execution frequency, used to pick the statements to prepare
+	Hits             uint64    // number of executions that used the prepared statement
+	Misses           uint64    // number of executions that did not use the prepared statement
+	Prepared         bool      // whether the statement is currently prepared (or would be, see WithShadowMode)
+	PreparedAt       time.Time // last time the statement was prepared (zero if never)
+	PrepareErrors    uint64    // number of failed attempts to prepare the statement
+	LastPrepareError string    // error returned by the last failed attempt to prepare the statement
+	Blacklisted      bool      // whether the statement is not prepared for a while, as it failed to be prepared recently
+	NotPreparable    bool      // whether the statement is not eligible to be prepared
+	Pinned           bool      // whether the statement has been pinned (see Pin)
+}
+
+// Snapshot returns statistics about all statements currently tracked, sorted
+// from the most to the least frequently executed. It is meant to be used to
+// inspect what autoprepare is doing, and it is too expensive to be called often.
+func (c *SQLStmtCache) Snapshot() []StmtStats {
+	now := atomic.LoadInt64(&c.now)
+	c.l.RLock()
+	stats := make([]StmtStats, 0, c.stmt.len())
+	c.stmt.each(func(s *stmt) {
+		stats = append(stats, s.stats(now))
+	})
+	c.l.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Heat != stats[j].Heat {
+			return stats[i].Heat > stats[j].Heat
+		}
+		return stats[i].Query < stats[j].Query
+	})
+	return stats
+}
+
+func (s *stmt) stats(now int64) StmtStats {
+	st := StmtStats{
+		Query:         s.q,
+		Heat:          atomic.LoadUint64(&s.hit),
+		Hits:          atomic.LoadUint64(&s.hits),
+		Misses:        atomic.LoadUint64(&s.misses),
+		PrepareErrors: atomic.LoadUint64(&s.prepareErrs),
+		Blacklisted:   s.isBlacklisted(now),
+		NotPreparable: s.notPreparable,
+		Pinned:        s.isPinned(),
+	}
+	s.lock.Lock()
+	st.Prepared = s.ps != nil || s.shadow
+	if s.preparedAt != 0 {
+		st.PreparedAt = time.Unix(0, s.preparedAt)
+	}
+	if s.lastErr != nil {
+		st.LastPrepareError = s.lastErr.Error()
+	}
+	s.lock.Unlock()
+	return st
+}
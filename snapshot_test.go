@@ -0,0 +1,142 @@
+package autoprepare
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS tables (a INT, b TEXT)")
+	if err != nil {
+		panic(err)
+	}
+
+	dbsc, err := New(db, WithWorkerInterval(10*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := context.Background()
+
+	const valid, invalid = "SELECT * FROM tables", "SELECT * FROM missing_table"
+
+	get := func() (v, i StmtStats) {
+		snap := dbsc.Snapshot()
+		for n, s := range snap {
+			if n > 0 && snap[n-1].Heat < s.Heat {
+				t.Errorf("snapshot not sorted by heat: %+v", snap)
+			}
+			switch s.Query {
+			case valid:
+				v = s
+			case invalid:
+				i = s
+			}
+		}
+		return
+	}
+
+	for i := 0; i < 10; i++ {
+		res, err := dbsc.QueryContext(ctx, valid)
+		if err != nil {
+			panic(err)
+		}
+		res.Close()
+	}
+	for n := 0; n < 100; n++ {
+		if v, _ := get(); v.Prepared {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the invalid query is executed more frequently, so it will be picked next
+	for i := 0; i < 20; i++ {
+		if _, err := dbsc.ExecContext(ctx, invalid); err == nil {
+			t.Fatalf("query on missing table succeeded")
+		}
+	}
+	for n := 0; n < 100; n++ {
+		if _, i := get(); i.PrepareErrors > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res, err := dbsc.QueryContext(ctx, valid)
+	if err != nil {
+		panic(err)
+	}
+	res.Close()
+
+	v, i := get()
+	if !v.Prepared || v.PreparedAt.IsZero() || v.Hits != 1 || v.Misses != 10 || v.PrepareErrors != 0 {
+		t.Errorf("unexpected stats for %q: %+v", valid, v)
+	}
+	if i.Prepared || !i.PreparedAt.IsZero() || i.Misses != 20 || i.PrepareErrors == 0 || i.LastPrepareError == "" {
+		t.Errorf("unexpected stats for %q: %+v", invalid, i)
+	}
+}
+
+func TestBlacklist(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dbsc, err := New(db, WithWorkerInterval(10*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+	defer dbsc.Close()
+
+	ctx := context.Background()
+	const valid, invalid = "SELECT 1", "SELECT * FROM missing_table"
+
+	// the invalid query is the hottest one, but after failing to be prepared
+	// it is blacklisted for a while, with a backoff that doubles at every failure,
+	// so the valid one can be prepared
+	for start := time.Now(); time.Since(start) < 500*time.Millisecond; {
+		for i := 0; i < 10; i++ {
+			dbsc.ExecContext(ctx, invalid)
+		}
+		if _, err := dbsc.ExecContext(ctx, valid); err != nil {
+			panic(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, s := range dbsc.Snapshot() {
+		switch s.Query {
+		case valid:
+			if !s.Prepared {
+				t.Errorf("unexpected stats for %q: %+v", valid, s)
+			}
+		case invalid:
+			if s.Prepared || s.PrepareErrors == 0 || s.PrepareErrors > 8 {
+				t.Errorf("unexpected stats for %q: %+v", invalid, s)
+			}
+		}
+	}
+	if s := dbsc.GetStats(); s.Blacklisted == 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
@@ -3,23 +3,70 @@ package autoprepare
 import (
 	"database/sql"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
+// stmtOverhead is the approximate amount of memory used to track a statement,
+// excluding the query text: the stmt itself, plus the map entry pointing to it.
+const stmtOverhead = int64(unsafe.Sizeof(stmt{})) + 48
+
+// trackedSize returns the approximate amount of memory used to track query.
+func trackedSize(query string) int64 {
+	return int64(len(query)) + stmtOverhead
+}
+
 type stmt struct {
+	// The 64-bit fields that are accessed atomically come first, so that they
+	// are 64-bit aligned also on 32-bit platforms (see the sync/atomic docs).
+	hit         uint64
+	used        int64 // last time the statement was used (UnixNano, coarse)
+	blacklisted int64 // the statement is not prepared again before this time (UnixNano), as it failed to be prepared
+
+	// statistics, see StmtStats
+	hits        uint64
+	misses      uint64
+	prepareErrs uint64
+
 	cond      sync.Cond
 	lock      sync.Mutex
 	ps        *sql.Stmt
 	psHandles uint32 // number of goroutines using ps
-	hit       uint64
 	q         string
+	h         uint64 // fingerprint of q; used only by hashed stmtTables
+	next      *stmt  // next stmt with the same fingerprint; protected by the cache lock
+
+	notPreparable bool   // q is not eligible to be prepared; constant after creation
+	pinned        uint32 // 1 if the statement has been pinned (see Pin)
+	warm          uint32 // 1 if the statement was prepared by WithWarmStart and has not been executed since
+	shadow        bool   // the statement would be prepared (see WithShadowMode); protected by lock
+
+	preparedAt int64        // protected by lock
+	lastErr    error        // protected by lock
+	lat        *stmtLatency // latency histograms; nil unless WithStmtLatency is used
 }
 
-func newStmt(sql string, hit uint64) *stmt {
-	s := &stmt{q: sql, hit: hit}
+func newStmt(sql string, h uint64, hit uint64, now int64) *stmt {
+	s := &stmt{q: sql, h: h, hit: hit, used: now}
 	s.cond.L = &s.lock
 	return s
 }
 
+func (s *stmt) use(now int64) {
+	// avoid writing to the shared cache line unless the coarse clock moved
+	if atomic.LoadInt64(&s.used) != now {
+		atomic.StoreInt64(&s.used, now)
+	}
+	if atomic.LoadUint32(&s.warm) != 0 {
+		atomic.StoreUint32(&s.warm, 0)
+	}
+}
+
+func (s *stmt) lastUsed() int64 {
+	return atomic.LoadInt64(&s.used)
+}
+
 func (s *stmt) acquire() *sql.Stmt {
 	if s == nil {
 		return nil
@@ -49,22 +96,74 @@ func (s *stmt) close() {
 	}
 	ps := s.ps
 	s.ps = nil
+	s.shadow = false
 	s.lock.Unlock()
-	ps.Close()
+	if ps != nil {
+		ps.Close()
+	}
 }
 
-func (s *stmt) put(v *sql.Stmt) {
+func (s *stmt) put(v *sql.Stmt, now int64) {
 	if v == nil {
 		panic("nil *sql.Stmt")
 	}
 	s.lock.Lock()
 	s.ps = v
+	s.preparedAt = now
 	s.lock.Unlock()
 }
 
+// putShadow marks the statement as prepared in shadow mode, without an actual
+// prepared statement (see WithShadowMode).
+func (s *stmt) putShadow(now int64) {
+	s.lock.Lock()
+	s.shadow = true
+	s.preparedAt = now
+	s.lock.Unlock()
+}
+
+// prepareFailed records that preparing the statement failed with err at time
+// now, and blacklists it for backoff, doubled for every previous failure (up to
+// maxPrepareBackoff): otherwise a hot statement that can not be prepared would
+// keep being picked, preventing other statements from being prepared.
+func (s *stmt) prepareFailed(err error, now int64, backoff time.Duration) {
+	s.lock.Lock()
+	s.lastErr = err
+	s.lock.Unlock()
+	for n := atomic.AddUint64(&s.prepareErrs, 1); n > 1 && backoff < maxPrepareBackoff; n-- {
+		backoff *= 2
+	}
+	if backoff > maxPrepareBackoff {
+		backoff = maxPrepareBackoff
+	}
+	atomic.StoreInt64(&s.blacklisted, now+int64(backoff))
+}
+
+// isBlacklisted returns whether the statement must not be prepared at time now
+// (see prepareFailed).
+func (s *stmt) isBlacklisted(now int64) bool {
+	return now < atomic.LoadInt64(&s.blacklisted)
+}
+
+func (s *stmt) pin() {
+	atomic.StoreUint32(&s.pinned, 1)
+}
+
+func (s *stmt) unpin() {
+	atomic.StoreUint32(&s.pinned, 0)
+}
+
+func (s *stmt) isPinned() bool {
+	return atomic.LoadUint32(&s.pinned) != 0
+}
+
+func (s *stmt) isWarm() bool {
+	return atomic.LoadUint32(&s.warm) != 0
+}
+
 func (s *stmt) prepared() (prepared bool) {
 	s.lock.Lock()
-	prepared = s.ps != nil
+	prepared = s.ps != nil || s.shadow
 	s.lock.Unlock()
 	return
 }
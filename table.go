@@ -0,0 +1,119 @@
+package autoprepare
+
+import (
+	"hash/maphash"
+)
+
+// stmtTable contains the tracked statements. By default it is keyed by the SQL
+// query itself. If hashed is set (see WithHashedKeys) it is instead keyed by a
+// 64 bit fingerprint of the query, that is computed outside of the cache lock,
+// and the text of the query is stored only once, in stmt.q. In this case
+// collisions are handled by chaining the colliding statements via stmt.next,
+// and comparing the full query text.
+type stmtTable struct {
+	byQuery map[string]*stmt
+	byHash  map[uint64]*stmt
+	seed    maphash.Seed
+	hashed  bool
+	n       int
+}
+
+func (t *stmtTable) init() {
+	if t.hashed {
+		t.seed = maphash.MakeSeed()
+		t.byHash = make(map[uint64]*stmt)
+	} else {
+		t.byQuery = make(map[string]*stmt)
+	}
+}
+
+// reset drops all statements from the table. The table can not be used anymore
+// after reset has been called.
+func (t *stmtTable) reset() {
+	t.byQuery, t.byHash, t.n = nil, nil, 0
+}
+
+func (t *stmtTable) closed() bool {
+	return t.byQuery == nil && t.byHash == nil
+}
+
+func (t *stmtTable) len() int {
+	return t.n
+}
+
+// hash returns the fingerprint of query. It does not require holding the
+// cache lock. If the table is not hashed it returns 0.
+func (t *stmtTable) hash(query string) uint64 {
+	if !t.hashed {
+		return 0
+	}
+	var h maphash.Hash
+	h.SetSeed(t.seed)
+	h.WriteString(query)
+	return h.Sum64()
+}
+
+// get returns the statement for query, whose fingerprint is h, if any.
+func (t *stmtTable) get(query string, h uint64) *stmt {
+	if !t.hashed {
+		return t.byQuery[query]
+	}
+	for s := t.byHash[h]; s != nil; s = s.next {
+		if s.q == query {
+			return s
+		}
+	}
+	return nil
+}
+
+// add adds s, that must not be in the table already, to the table.
+func (t *stmtTable) add(s *stmt) {
+	if !t.hashed {
+		t.byQuery[s.q] = s
+	} else {
+		s.next = t.byHash[s.h]
+		t.byHash[s.h] = s
+	}
+	t.n++
+}
+
+// remove removes s from the table. It returns false if s was not in the table.
+func (t *stmtTable) remove(s *stmt) bool {
+	if !t.hashed {
+		if t.byQuery[s.q] != s {
+			return false
+		}
+		delete(t.byQuery, s.q)
+		t.n--
+		return true
+	}
+	var prev *stmt
+	for cur := t.byHash[s.h]; cur != nil; prev, cur = cur, cur.next {
+		if cur != s {
+			continue
+		}
+		if prev != nil {
+			prev.next = cur.next
+		} else if cur.next != nil {
+			t.byHash[s.h] = cur.next
+		} else {
+			delete(t.byHash, s.h)
+		}
+		cur.next = nil
+		t.n--
+		return true
+	}
+	return false
+}
+
+// each calls f for every statement in the table. f must not modify the table.
+func (t *stmtTable) each(f func(*stmt)) {
+	for _, s := range t.byQuery {
+		f(s)
+	}
+	for _, s := range t.byHash {
+		for ; s != nil; s = s.next {
+			f(s)
+		}
+	}
+}
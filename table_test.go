@@ -0,0 +1,59 @@
+package autoprepare
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStmtTableCollisions(t *testing.T) {
+	tbl := stmtTable{hashed: true}
+	tbl.init()
+
+	// force all statements to have the same fingerprint
+	const h = 42
+	var stmts []*stmt
+	for i := 0; i < 3; i++ {
+		s := newStmt(fmt.Sprintf("SELECT %d", i), h, 1, 0)
+		tbl.add(s)
+		stmts = append(stmts, s)
+	}
+
+	if n := tbl.len(); n != 3 {
+		t.Fatalf("unexpected length: %d", n)
+	}
+	for _, s := range stmts {
+		if got := tbl.get(s.q, h); got != s {
+			t.Errorf("unexpected statement for %q: %v", s.q, got)
+		}
+	}
+	if got := tbl.get("SELECT 3", h); got != nil {
+		t.Errorf("unexpected statement: %v", got)
+	}
+
+	if !tbl.remove(stmts[1]) {
+		t.Errorf("statement not removed")
+	}
+	if tbl.remove(stmts[1]) {
+		t.Errorf("statement removed twice")
+	}
+	if got := tbl.get(stmts[1].q, h); got != nil {
+		t.Errorf("unexpected statement after remove: %v", got)
+	}
+
+	n := 0
+	tbl.each(func(s *stmt) {
+		if s == stmts[1] {
+			t.Errorf("removed statement still in table")
+		}
+		n++
+	})
+	if n != 2 || tbl.len() != 2 {
+		t.Errorf("unexpected length: %d, %d", n, tbl.len())
+	}
+
+	tbl.remove(stmts[0])
+	tbl.remove(stmts[2])
+	if len(tbl.byHash) != 0 || tbl.len() != 0 {
+		t.Errorf("table not empty: %v, %d", tbl.byHash, tbl.len())
+	}
+}
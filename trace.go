@@ -0,0 +1,154 @@
+package autoprepare
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// traceBuffer is the number of trace records that can be queued before they
+// start being dropped.
+const traceBuffer = 4096
+
+// TraceRecord is a sampled query, as written by the trace recorder (see
+// WithTraceRecorder). The trace is line-delimited JSON: each line contains a
+// single JSON object with the following fields:
+//
+//	t    start time of the query, in nanoseconds since the Unix epoch
+//	fp   fingerprint of the SQL query: its 64 bit FNV-1a hash, as 16 hex digits
+//	len  length of the SQL query, in bytes
+//	dur  time taken to execute the query, in nanoseconds
+//	hit  whether the query used an automatically-prepared statement
+//
+// e.g.
+//
+//	{"t":1600000000000000000,"fp":"af63bd4c8601b7df","len":31,"dur":125000,"hit":true}
+//
+// Neither the text of the queries nor the values of their arguments are recorded.
+type TraceRecord struct {
+	Time        int64  `json:"t"`
+	Fingerprint string `json:"fp"`
+	Len         int    `json:"len"`
+	Duration    int64  `json:"dur"`
+	Hit         bool   `json:"hit"`
+}
+
+// Fingerprint returns the fingerprint of query used in TraceRecord.
+func Fingerprint(query string) string {
+	h := fnv.New64a()
+	io.WriteString(h, query)
+	var b [8]byte
+	return hex.EncodeToString(h.Sum(b[:0]))
+}
+
+// WithTraceRecorder makes autoprepare write to w a trace of the queries executed
+// via the SQLStmtCache, in the format described by TraceRecord, e.g. to tune the
+// options offline. Only a fraction sampleRate (0 < sampleRate <= 1) of the queries
+// is recorded: with a sampleRate of 0.01, one query every 100 is recorded.
+// The trace is written by a background goroutine: if w can not keep up, records
+// are dropped (see SQLStmtCacheStats.TraceDropped). If w returns an error, all
+// following records are dropped. Close stops the trace recorder, after writing all queued
+// records; it does not close w.
+func WithTraceRecorder(w io.Writer, sampleRate float64) SQLStmtCacheOpt {
+	return func(c *SQLStmtCache) error {
+		if w == nil {
+			return errors.New("WithTraceRecorder writer should not be nil")
+		}
+		if !(sampleRate > 0 && sampleRate <= 1) {
+			return errors.New("WithTraceRecorder sampleRate should be more than 0 and no more than 1")
+		}
+		c.trace = &traceRecorder{
+			w:     w,
+			every: uint64(math.Round(1 / sampleRate)),
+			ch:    make(chan TraceRecord, traceBuffer),
+			stop:  make(chan struct{}),
+			done:  make(chan struct{}),
+		}
+		return nil
+	}
+}
+
+// traceRecorder writes the sampled queries to w. It is a separate object, so
+// that its goroutine does not keep the SQLStmtCache alive.
+type traceRecorder struct {
+	n       uint64 // number of queries seen; first, to be 64-bit aligned on 32-bit platforms
+	dropped uint64 // number of records dropped because ch was full
+	every   uint64 // record one query every this many
+	w       io.Writer
+	ch      chan TraceRecord
+	stop    chan struct{} // closed by close to stop the recorder
+	done    chan struct{} // closed by run when it exits
+}
+
+// record queues call to be written, if it is sampled.
+func (t *traceRecorder) record(call *Call) {
+	if t == nil || (atomic.AddUint64(&t.n, 1)-1)%t.every != 0 {
+		return
+	}
+	r := TraceRecord{
+		Time:        time.Now().Add(-call.dur).UnixNano(),
+		Fingerprint: Fingerprint(call.Query),
+		Len:         len(call.Query),
+		Duration:    int64(call.dur),
+		Hit:         call.ps != nil,
+	}
+	select {
+	case t.ch <- r:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+func (t *traceRecorder) run() {
+	defer close(t.done)
+	bw := bufio.NewWriter(t.w)
+	enc := json.NewEncoder(bw)
+	var err error
+	write := func(r TraceRecord) {
+		if err == nil {
+			err = enc.Encode(r)
+		}
+		if err != nil {
+			atomic.AddUint64(&t.dropped, 1)
+		}
+	}
+	for {
+		select {
+		case r := <-t.ch:
+			write(r)
+			// flush only once the queue is empty, to write in batches
+			if len(t.ch) == 0 && err == nil {
+				err = bw.Flush()
+			}
+		case <-t.stop:
+			for len(t.ch) > 0 {
+				write(<-t.ch)
+			}
+			if err == nil {
+				bw.Flush()
+			}
+			return
+		}
+	}
+}
+
+func (t *traceRecorder) close() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+}
+
+func (t *traceRecorder) droppedRecords() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.dropped)
+}
@@ -0,0 +1,96 @@
+package autoprepare
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceRecorder(t *testing.T) {
+	if *SqliteDSN == "" {
+		t.Skip("SQLite is disabled")
+	}
+
+	db, err := sql.Open("sqlite3", *SqliteDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	var buf bytes.Buffer
+	dbsc, err := New(db, WithTraceRecorder(&buf, 0.5))
+	if err != nil {
+		panic(err)
+	}
+
+	ctx := context.Background()
+	start := time.Now()
+	queries := []string{"SELECT ? + 1", "SELECT ? + 2", "SELECT ? + 3", "SELECT ? + 4", "SELECT ? + 5"}
+	for _, q := range queries {
+		if _, err := dbsc.ExecContext(ctx, q, "s3cr3t"); err != nil {
+			panic(err)
+		}
+	}
+	dbsc.Close()
+
+	if strings.Contains(buf.String(), "SELECT") || strings.Contains(buf.String(), "s3cr3t") {
+		t.Errorf("query text or arguments recorded: %s", buf.String())
+	}
+	var recs []TraceRecord
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var r TraceRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("invalid record %q: %v", sc.Text(), err)
+		}
+		recs = append(recs, r)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("unexpected records: %+v", recs)
+	}
+	for i, r := range recs {
+		q := queries[i*2]
+		if r.Fingerprint != Fingerprint(q) || r.Len != len(q) || r.Hit || r.Duration <= 0 || r.Time < start.UnixNano() || r.Time > time.Now().UnixNano() {
+			t.Errorf("unexpected record %d: %+v", i, r)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	// FNV-1a test vectors
+	for q, exp := range map[string]string{
+		"":    "cbf29ce484222325",
+		"a":   "af63dc4c8601ec8c",
+		"foo": "dcb27518fed9d577",
+	} {
+		if fp := Fingerprint(q); fp != exp {
+			t.Errorf("Fingerprint(%q): got %s, want %s", q, fp, exp)
+		}
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, errors.New("write error") }
+
+func TestTraceRecorderError(t *testing.T) {
+	c := &SQLStmtCache{&sqlStmtCache{}}
+	if err := WithTraceRecorder(errWriter{}, 1)(c); err != nil {
+		t.Fatal(err)
+	}
+	go c.trace.run()
+	for i := 0; i < 100; i++ {
+		c.trace.record(&Call{Query: "SELECT 1"})
+	}
+	// the recorder must not block, and it must be possible to stop it
+	c.trace.close()
+	if n := c.trace.droppedRecords(); n == 0 || n > 100 {
+		t.Errorf("unexpected dropped records: %d", n)
+	}
+}